@@ -1,32 +1,40 @@
 package api
 
 import (
-	"context"
-	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"net/http"
-	"os"
-	"strconv"
+	"reflect"
 	"strings"
 	"sync"
+	"time"
 
 	_command "github.com/factorysh/stream_my_command/command"
-	"github.com/factorysh/stream_my_command/stream"
+	"github.com/factorysh/stream_my_command/rfc7233"
+	"github.com/gorilla/websocket"
 )
 
 type Command struct {
-	Slug        string
-	Command     string
-	Arguments   []string
-	ContentType string
-	Environment map[string]string
+	Slug        string            `yaml:"slug"`
+	Command     string            `yaml:"command"`
+	Arguments   []string          `yaml:"arguments"`
+	ContentType string            `yaml:"content_type"`
+	Environment map[string]string `yaml:"environment"`
+	Concurrency int               `yaml:"concurrency"`
+	MaxDuration time.Duration     `yaml:"max_duration"`
+	GracePeriod time.Duration     `yaml:"grace_period"`
+	TTL         time.Duration     `yaml:"ttl"`
+	History     int               `yaml:"history"`
+	Webhook     string            `yaml:"webhook"`
+	// hosts of the webhooks named by the requests
+	WebhookHosts []string `yaml:"webhook_hosts"`
 }
 
 func Register(server *http.ServeMux, command Command) error {
-	if command.ContentType == "" {
-		command.ContentType = "text/plain"
+	err := command.Validate()
+	if err != nil {
+		return err
 	}
-
 	uri := fmt.Sprintf("/api/v1/%s/", command.Slug)
 	fmt.Println("uri", uri)
 	h, err := command.Handler()
@@ -37,119 +45,379 @@ func Register(server *http.ServeMux, command Command) error {
 	return nil
 }
 
-type Run struct {
-	Bucket *stream.Bucket
-	Cancel context.CancelFunc
+// parseRanges returns the ranges of the Range header, nil without Range,
+// or with an unknown unit
+func parseRanges(r *http.Request) (*rfc7233.Ranges, error) {
+	rangeRaw := r.Header.Get("range")
+	if rangeRaw == "" {
+		return nil, nil
+	}
+	ranges, err := rfc7233.Parse(rangeRaw)
+	if err == rfc7233.ErrUnknownUnit {
+		return nil, nil
+	}
+	return ranges, err
 }
 
-func simpleStartRange(rangeRaw string) (int, error) {
-	rr := strings.Split(rangeRaw, "=")
-	if len(rr) != 2 || rr[0] != "bytes" {
-		return 0, fmt.Errorf("Not bytes : %s", rangeRaw)
-	}
-	startend := strings.Split(rr[1], "-")
-	seek, err := strconv.Atoi(startend[0])
+// wantsStatus says if the client asks for the JSON status, not the output
+func wantsStatus(r *http.Request, contentType string) bool {
+	return (r.Method == "GET" || r.Method == "HEAD") &&
+		strings.HasPrefix(r.Header.Get("Accept"), "application/json") &&
+		!strings.HasPrefix(contentType, "application/json")
+}
+
+// wantsFresh says if the client asks for a new run, with a POST or a
+// Cache-Control: no-cache
+func wantsFresh(r *http.Request) bool {
+	return r.Method == "POST" ||
+		(r.Method == "GET" && strings.Contains(r.Header.Get("Cache-Control"), "no-cache"))
+}
+
+// Handler returns a standalone handler for this command
+func (c *Command) Handler() (http.HandlerFunc, error) {
+	h, err := newHandler(*c, nil, nil)
 	if err != nil {
-		fmt.Println("error", err)
-		return 0, fmt.Errorf("Bof")
+		return nil, err
 	}
-	// FIXME handle end range
-	return seek, nil
+	return h.ServeHTTP, nil
 }
 
-func (c *Command) Handler() (http.HandlerFunc, error) {
-	pool := _command.NewPool()
-	arguments, err := _command.NewArguments(c.Arguments...)
+type handler struct {
+	lock      *sync.RWMutex
+	command   Command
+	arguments _command.Arguments
+	pool      *_command.Pool
+	buffers   map[string]*Run
+	history   map[string][]*Run
+	runs      *runs
+	finished  func(*Run)
+	storage   string
+	removed   bool
+}
+
+// newHandler returns a handler, its pool uses slots of the parent pool, if any.
+// Its runs are added to the index, if any.
+func newHandler(command Command, parent *_command.Pool, index *runs) (*handler, error) {
+	if index == nil {
+		index = newRuns()
+	}
+	h := &handler{
+		lock:    &sync.RWMutex{},
+		buffers: make(map[string]*Run),
+		history: make(map[string][]*Run),
+		runs:    index,
+	}
+	if parent == nil {
+		h.pool = _command.NewPool(command.Concurrency)
+	} else {
+		h.pool = parent.Child(command.Concurrency)
+	}
+	err := h.update(command)
 	if err != nil {
 		return nil, err
 	}
-	buffers := make(map[string]*Run)
-	lock := &sync.RWMutex{}
+	return h, nil
+}
 
-	return func(w http.ResponseWriter, r *http.Request) {
-		slugs := strings.Split(r.URL.Path, "/")
-		fmt.Println("slugs", slugs)
-		zargs, err := arguments.Values(slugs[4:]...)
-		if err != nil {
-			fmt.Println("error", err)
-			w.WriteHeader(400)
-			return
+// update the command definition. Running commands are not touched,
+// finished runs of a modified command are forgotten.
+func (h *handler) update(command Command) error {
+	if command.ContentType == "" {
+		command.ContentType = "text/plain"
+	}
+	arguments, err := _command.NewArguments(command.Arguments...)
+	if err != nil {
+		return err
+	}
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if !reflect.DeepEqual(h.command, command) {
+		for k, run := range h.buffers {
+			if run.Bucket.Closed() {
+				delete(h.buffers, k)
+			}
 		}
-		fmt.Println("zargs", zargs)
-		k := strings.Join(zargs, "/")
-		seek := 0
-		rangeRaw := r.Header.Get("range")
-		if rangeRaw != "" {
-			seek, err = simpleStartRange(rangeRaw)
-			if err != nil {
-				w.WriteHeader(400)
-				return
+		for k, runs := range h.history {
+			kept := make([]*Run, 0, len(runs))
+			for _, run := range runs {
+				if !run.Bucket.Closed() {
+					kept = append(kept, run)
+				}
 			}
+			h.history[k] = kept
 		}
-		lock.Lock()
-		run, ok := buffers[k]
-		if !ok {
-			if r.Method != "GET" {
-				w.WriteHeader(http.StatusMethodNotAllowed)
-				lock.Unlock()
-				return
+	}
+	h.command = command
+	h.arguments = arguments
+	h.pool.SetSize(command.Concurrency)
+	h.removed = false
+	return nil
+}
+
+// forget the run, from the current runs and the history
+func (h *handler) forget(run *Run) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	if h.buffers[run.key] == run {
+		delete(h.buffers, run.key)
+	}
+	runs := h.history[run.key]
+	for i, r := range runs {
+		if r == run {
+			h.history[run.key] = append(runs[:i:i], runs[i+1:]...)
+			break
+		}
+	}
+	if len(h.history[run.key]) == 0 {
+		delete(h.history, run.key)
+	}
+}
+
+// push a new current run, and returns the finished runs out of the history.
+// The lock must be held.
+func (h *handler) push(k string, run *Run) []*Run {
+	h.buffers[k] = run
+	runs := append([]*Run{run}, h.history[k]...)
+	dropped := make([]*Run, 0)
+	if h.command.History > 0 && len(runs) > h.command.History {
+		kept := runs[:h.command.History]
+		for _, old := range runs[h.command.History:] {
+			if old.State() == _command.Finished {
+				dropped = append(dropped, old)
+			} else {
+				kept = append(kept, old)
 			}
-			longBuffer, err := stream.NewBucket(os.TempDir(), 10*1024*1024)
-			if err != nil {
-				fmt.Println("error", err)
-				w.WriteHeader(500)
+		}
+		runs = kept
+	}
+	h.history[k] = runs
+	return dropped
+}
+
+// lookup a run : the current one, the "previous" one, or a run by its ID
+func (h *handler) lookup(k, which string) (*Run, bool) {
+	h.lock.RLock()
+	defer h.lock.RUnlock()
+	if which == "" {
+		run, ok := h.buffers[k]
+		return run, ok
+	}
+	runs := h.history[k]
+	if which == "previous" {
+		if len(runs) < 2 {
+			return nil, false
+		}
+		return runs[1], true
+	}
+	for _, run := range runs {
+		if run.ID().String() == which {
+			return run, true
+		}
+	}
+	return nil, false
+}
+
+// serveHistory lists the status of the runs, the most recent first
+func (h *handler) serveHistory(w http.ResponseWriter, r *http.Request, k string) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	h.lock.RLock()
+	runs := h.history[k]
+	h.lock.RUnlock()
+	statuses := make([]*Status, len(runs))
+	for i, run := range runs {
+		statuses[i] = run.Status()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(statuses)
+	if err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+// restore a run of a previous server in the history
+func (h *handler) restore(run *Run) {
+	h.lock.Lock()
+	dropped := h.push(run.key, run)
+	h.lock.Unlock()
+	for _, old := range dropped {
+		h.drop(old)
+	}
+}
+
+// setStorage sets the folder of the new buckets
+func (h *handler) setStorage(storage string) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.storage = storage
+}
+
+// remove the command : no more new runs, current runs are still available
+func (h *handler) remove() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+	h.removed = true
+}
+
+func (h *handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	slugs := strings.Split(r.URL.Path, "/")
+	fmt.Println("slugs", slugs)
+	h.lock.RLock()
+	c := h.command
+	arguments := h.arguments
+	storage := h.storage
+	h.lock.RUnlock()
+	arity := arguments.Arity()
+	if len(slugs) < 4+arity {
+		w.WriteHeader(400)
+		return
+	}
+	zargs, err := arguments.Values(slugs[4 : 4+arity]...)
+	if err != nil {
+		fmt.Println("error", err)
+		w.WriteHeader(400)
+		return
+	}
+	fmt.Println("zargs", zargs)
+	output := strings.Join(slugs[4+arity:], "/")
+	k := runKey(zargs)
+	switch output {
+	case "", "stderr", "status", "ws":
+	case "history":
+		h.serveHistory(w, r, k)
+		return
+	case "diff":
+		h.serveDiff(w, r, k)
+		return
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	// nothing is started for a WebSocket without its upgrade
+	if output == "ws" && !websocket.IsWebSocketUpgrade(r) {
+		w.WriteHeader(http.StatusBadRequest)
+		return
+	}
+	which := r.URL.Query().Get("run")
+	if output == "status" || which != "" || (output == "" && wantsStatus(r, c.ContentType)) {
+		run, ok := h.lookup(k, which)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		run.handle(w, r, output)
+		return
+	}
+	ranges, err := parseRanges(r)
+	if err != nil {
+		w.WriteHeader(400)
+		return
+	}
+	hook := r.URL.Query().Get("webhook")
+	if hook == "" {
+		hook = c.Webhook
+	} else if err = validateWebhook(hook); err != nil {
+		w.WriteHeader(400)
+		return
+	} else if !c.allowsWebhook(hook) {
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+	h.lock.Lock()
+	run, ok := h.buffers[k]
+	if ok && wantsFresh(r) {
+		if run.State() != _command.Finished {
+			if r.URL.Query().Get("replace") == "" {
+				h.lock.Unlock()
+				w.Header().Set("X-Id", run.ID().String())
+				w.WriteHeader(http.StatusConflict)
 				return
 			}
-			run = &Run{
-				Bucket: longBuffer,
-			}
-			buffers[k] = run
-			lock.Unlock()
-			var ctx context.Context
-			ctx, run.Cancel = context.WithCancel(context.TODO())
+			run.Cancel()
+		}
+		ok = false
+	}
+	if !ok {
+		// HEAD never starts a command
+		if h.removed || r.Method == "HEAD" {
+			w.WriteHeader(http.StatusNotFound)
+			h.lock.Unlock()
+			return
+		}
+		if r.Method != "GET" && r.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			h.lock.Unlock()
+			return
+		}
+		run, err = newRun(c, zargs, storage)
+		if err != nil {
+			fmt.Println("error", err)
+			w.WriteHeader(500)
+			h.lock.Unlock()
+			return
+		}
+		if hook != "" {
+			run.webhook = newWebhook(hook)
+		}
+		dropped := h.push(k, run)
+		h.lock.Unlock()
+		for _, old := range dropped {
+			h.drop(old)
+		}
+		h.runs.add(run)
+		h.start(run)
+		if !run.setQueueHeaders(w) {
 			w.Header().Set("Stream-Status", "fresh")
-			go func() {
-				pool.Command(ctx, longBuffer, c.Environment, c.Command, zargs...)
-				longBuffer.Close()
-			}()
-		} else {
-			lock.Unlock()
-			if r.Method == "DELETE" {
-				run.Cancel()
-				w.Header().Set("X-Id", run.Bucket.ID().String())
-				w.WriteHeader(200)
-				return
-			}
-			if r.Method != "GET" {
-				w.WriteHeader(http.StatusMethodNotAllowed)
-				return
-			}
-			if run.Bucket.Closed() {
-				w.Header().Set("Content-Length", fmt.Sprintf("%d", run.Bucket.Len()-seek))
-				w.Header().Set("etag", hex.EncodeToString(run.Bucket.Hash()))
-				if seek > 0 {
-					w.Header().Add("Content-Range",
-						fmt.Sprintf("bytes %d-%d/%d",
-							seek,
-							run.Bucket.Len()-1,
-							run.Bucket.Len()))
-				}
-			} else {
-				if seek > 0 {
-					w.Header().Add("Content-Range", fmt.Sprintf("bytes %d/*", seek))
-				}
-			}
+		}
+		if r.Method == "POST" && r.URL.Query().Get("async") != "" {
+			run.accept(w)
+			return
+		}
+	} else {
+		h.lock.Unlock()
+		if r.Method == "DELETE" && output == "" {
+			run.delete(w)
+			return
+		}
+		if r.Method != "GET" && r.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		if !run.setQueueHeaders(w) {
 			w.Header().Set("Stream-Status", "refurbished")
 		}
-		w.Header().Set("Content-Type", c.ContentType)
-		w.Header().Set("Accept-Ranges", "bytes")
-		w.Header().Set("X-Id", run.Bucket.ID().String())
-		if seek > 0 {
-			w.WriteHeader(206) // Partial content
+	}
+	if output == "ws" {
+		run.serveWebSocket(w, r)
+		return
+	}
+	run.serve(w, r, output, ranges)
+}
+
+// drop a run out of the history, and remove its buckets.
+// A run with readers is removed when its last reader detaches.
+func (h *handler) drop(run *Run) {
+	run.drop(h.runs)
+}
+
+// start the run in the pool, and wait until it's running or queued
+func (h *handler) start(run *Run) {
+	go func() {
+		err := h.pool.Run(run.ctx, run.Job)
+		if err != nil {
+			fmt.Println("error", err)
+		}
+		err = run.save()
+		if err != nil {
+			fmt.Println("error", err)
 		}
-		if f, ok := w.(http.Flusher); ok {
-			f.Flush()
+		close(run.done)
+		if h.finished != nil {
+			h.finished(run)
 		}
-		run.Bucket.Copy(seek, w)
-	}, nil
+		run.notify()
+	}()
+	<-run.Job.Scheduled()
 }
@@ -0,0 +1,1127 @@
+package api
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQueued(t *testing.T) {
+	home, err := ioutil.TempDir(os.TempDir(), "queued_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	server := NewServer()
+	err = server.Register(Command{
+		Slug:        "touch",
+		Command:     "sh",
+		Arguments:   []string{"-c", "while [ ! -e $HOME/go ]; do sleep 0.01; done; echo $0; touch $HOME/$0", "$1"},
+		Environment: map[string]string{"HOME": home},
+		Concurrency: 1,
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	first := "first"
+	r, err := http.Get(ts.URL + "/api/v1/touch/" + first)
+	assert.NoError(t, err)
+	assert.Equal(t, "fresh", r.Header.Get("Stream-Status"))
+	defer r.Body.Close()
+
+	second := "second"
+	r2, err := http.Get(ts.URL + "/api/v1/touch/" + second)
+	assert.NoError(t, err)
+	assert.Equal(t, "queued", r2.Header.Get("Stream-Status"))
+	assert.Equal(t, "1", r2.Header.Get("Queue-Position"))
+
+	third := "third"
+	r3, err := http.Get(ts.URL + "/api/v1/touch/" + third)
+	assert.NoError(t, err)
+	assert.Equal(t, "queued", r3.Header.Get("Stream-Status"))
+	assert.Equal(t, "2", r3.Header.Get("Queue-Position"))
+	r3.Body.Close()
+
+	req, err := http.NewRequest("DELETE", ts.URL+"/api/v1/touch/"+third, nil)
+	assert.NoError(t, err)
+	r4, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, 200, r4.StatusCode)
+
+	// the commands wait for this file
+	assert.NoError(t, ioutil.WriteFile(path.Join(home, "go"), nil, 0600))
+	body, err := ioutil.ReadAll(r.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, first+"\n", string(body))
+	body, err = ioutil.ReadAll(r2.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, second+"\n", string(body))
+	r2.Body.Close()
+
+	_, err = os.Stat(path.Join(home, first))
+	assert.NoError(t, err)
+	_, err = os.Stat(path.Join(home, third))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestStderr(t *testing.T) {
+	server := NewServer()
+	err := server.Register(Command{
+		Slug:      "stderr",
+		Command:   "sh",
+		Arguments: []string{"-c", "echo out; echo $0 >&2; sleep 0.1; echo end >&2", "$1"},
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	r, body := get(t, ts.URL+"/api/v1/stderr/oups/stderr")
+	assert.Equal(t, 200, r.StatusCode)
+	assert.Equal(t, "fresh", r.Header.Get("Stream-Status"))
+	assert.Equal(t, "oups\nend\n", body)
+
+	r, body = get(t, ts.URL+"/api/v1/stderr/oups")
+	assert.Equal(t, "refurbished", r.Header.Get("Stream-Status"))
+	assert.Equal(t, "out\n", body)
+
+	req, err := http.NewRequest("GET", ts.URL+"/api/v1/stderr/oups/stderr", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Range", "bytes=5-")
+	r, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer r.Body.Close()
+	assert.Equal(t, 206, r.StatusCode)
+	assert.Equal(t, "bytes 5-8/9", r.Header.Get("Content-Range"))
+	b, err := ioutil.ReadAll(r.Body)
+	assert.NoError(t, err)
+	assert.Equal(t, "end\n", string(b))
+
+	r, _ = get(t, ts.URL+"/api/v1/stderr/oups/nope")
+	assert.Equal(t, http.StatusNotFound, r.StatusCode)
+}
+
+func TestTrailers(t *testing.T) {
+	server := NewServer()
+	err := server.Register(Command{
+		Slug:      "exit",
+		Command:   "sh",
+		Arguments: []string{"-c", "echo hello; sleep 0.1; exit $0", "$1"},
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	r, body := get(t, ts.URL+"/api/v1/exit/0")
+	assert.Equal(t, "hello\n", body)
+	assert.Equal(t, "0", r.Trailer.Get("Stream-Exit-Code"))
+	assert.Equal(t, "success", r.Trailer.Get("Stream-Outcome"))
+	assert.Equal(t,
+		"5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03",
+		r.Trailer.Get("Stream-Sha256"))
+	assert.NotEmpty(t, r.Trailer.Get("Stream-Duration"))
+
+	r, body = get(t, ts.URL+"/api/v1/exit/0")
+	assert.Equal(t, "hello\n", body)
+	assert.Equal(t, "0", r.Header.Get("Stream-Exit-Code"))
+	assert.Equal(t, "success", r.Header.Get("Stream-Outcome"))
+
+	r, _ = get(t, ts.URL+"/api/v1/exit/2")
+	assert.Equal(t, "2", r.Trailer.Get("Stream-Exit-Code"))
+	assert.Equal(t, "failed", r.Trailer.Get("Stream-Outcome"))
+}
+
+func TestStatus(t *testing.T) {
+	home, err := ioutil.TempDir(os.TempDir(), "status_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	server := NewServer()
+	err = server.Register(Command{
+		Slug:        "status",
+		Command:     "sh",
+		Arguments:   []string{"-c", "echo $0; while [ ! -e $HOME/go ]; do sleep 0.01; done; exit 1", "$1"},
+		Environment: map[string]string{"HOME": home},
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	// the command runs until this file exists
+	marker := path.Join(home, "go")
+	defer ioutil.WriteFile(marker, nil, 0600)
+
+	r, _ := get(t, ts.URL+"/api/v1/status/hello/status")
+	assert.Equal(t, http.StatusNotFound, r.StatusCode)
+
+	r, err = http.Get(ts.URL + "/api/v1/status/hello")
+	assert.NoError(t, err)
+	defer r.Body.Close()
+	id := r.Header.Get("X-Id")
+
+	// until the first line is written, and its reader attached
+	var status Status
+	var r2 *http.Response
+	var body string
+	for i := 0; i < 500 && (status.Length != 6 || status.Readers != 1); i++ {
+		time.Sleep(10 * time.Millisecond)
+		status = Status{}
+		r2, body = get(t, ts.URL+"/api/v1/status/hello/status")
+		assert.NoError(t, json.Unmarshal([]byte(body), &status))
+	}
+	assert.Equal(t, 200, r2.StatusCode)
+	assert.Equal(t, "application/json", r2.Header.Get("Content-Type"))
+	assert.NoError(t, json.Unmarshal([]byte(body), &status))
+	assert.Equal(t, id, status.ID)
+	assert.Equal(t, []string{"sh", "-c", "echo $0; while [ ! -e $HOME/go ]; do sleep 0.01; done; exit 1", "hello"}, status.Argv)
+	assert.Equal(t, "running", status.State)
+	assert.Equal(t, 1, status.Readers)
+	assert.Equal(t, 6, status.Length)
+	assert.NotNil(t, status.Start)
+	assert.Nil(t, status.End)
+	assert.Nil(t, status.ExitCode)
+
+	assert.NoError(t, ioutil.WriteFile(marker, nil, 0600))
+	_, err = ioutil.ReadAll(r.Body)
+	assert.NoError(t, err)
+
+	req, err := http.NewRequest("GET", ts.URL+"/api/v1/status/hello", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Accept", "application/json")
+	r3, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer r3.Body.Close()
+	status = Status{}
+	assert.NoError(t, json.NewDecoder(r3.Body).Decode(&status))
+	assert.Equal(t, "finished", status.State)
+	assert.Equal(t, "failed", status.Outcome)
+	assert.Equal(t, 0, status.Readers)
+	assert.Equal(t, 1, *status.ExitCode)
+	assert.NotNil(t, status.End)
+	assert.Len(t, status.Sha256, 64)
+}
+
+func TestRunByID(t *testing.T) {
+	server := NewServer()
+	err := server.Register(Command{
+		Slug:      "echo",
+		Command:   "sh",
+		Arguments: []string{"-c", "echo $0; echo oups >&2", "$1"},
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	r, body := get(t, ts.URL+"/api/v1/echo/hello")
+	assert.Equal(t, "hello\n", body)
+	id := r.Header.Get("X-Id")
+
+	r, body = get(t, ts.URL+"/api/v1/runs/"+id)
+	assert.Equal(t, 200, r.StatusCode)
+	assert.Equal(t, "hello\n", body)
+	assert.Equal(t, id, r.Header.Get("X-Id"))
+
+	_, body = get(t, ts.URL+"/api/v1/runs/"+id+"/stderr")
+	assert.Equal(t, "oups\n", body)
+
+	var status Status
+	r, body = get(t, ts.URL+"/api/v1/runs/"+id+"/status")
+	assert.Equal(t, 200, r.StatusCode)
+	assert.NoError(t, json.Unmarshal([]byte(body), &status))
+	assert.Equal(t, id, status.ID)
+	assert.Equal(t, "success", status.Outcome)
+
+	r, _ = get(t, ts.URL+"/api/v1/runs/"+uuid.New().String())
+	assert.Equal(t, http.StatusNotFound, r.StatusCode)
+	r, _ = get(t, ts.URL+"/api/v1/runs/nope")
+	assert.Equal(t, http.StatusNotFound, r.StatusCode)
+}
+
+func TestExpire(t *testing.T) {
+	server := NewServer()
+	err := server.Register(Command{
+		Slug:      "echo",
+		Command:   "echo",
+		Arguments: []string{"$1"},
+		TTL:       100 * time.Millisecond,
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	r, body := get(t, ts.URL+"/api/v1/echo/hello")
+	assert.Equal(t, "hello\n", body)
+	id := r.Header.Get("X-Id")
+	var status Status
+	_, body = get(t, ts.URL+"/api/v1/runs/"+id+"/status")
+	assert.NoError(t, json.Unmarshal([]byte(body), &status))
+
+	server.Expire()
+	r, _ = get(t, ts.URL+"/api/v1/echo/hello")
+	assert.Equal(t, "refurbished", r.Header.Get("Stream-Status"))
+
+	time.Sleep(150 * time.Millisecond)
+	server.Expire()
+	_, err = os.Stat(status.Path)
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(status.StderrPath)
+	assert.True(t, os.IsNotExist(err))
+	r, _ = get(t, ts.URL+"/api/v1/runs/"+id)
+	assert.Equal(t, http.StatusNotFound, r.StatusCode)
+
+	r, body = get(t, ts.URL+"/api/v1/echo/hello")
+	assert.Equal(t, "fresh", r.Header.Get("Stream-Status"))
+	assert.Equal(t, "hello\n", body)
+	assert.NotEqual(t, id, r.Header.Get("X-Id"))
+}
+
+func TestEvict(t *testing.T) {
+	home, err := ioutil.TempDir(os.TempDir(), "evict_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	server := NewServer()
+	// each output is written once, with a stamp of 16 bytes
+	err = server.Load(&Config{
+		Quota: 66,
+		Commands: []Command{
+			{
+				Slug:      "echo",
+				Command:   "echo",
+				Arguments: []string{"$1"},
+			},
+			{
+				Slug:        "slow",
+				Command:     "sh",
+				Arguments:   []string{"-c", "echo $0; while [ ! -e $HOME/go ]; do sleep 0.01; done", "$1"},
+				Environment: map[string]string{"HOME": home},
+			},
+		},
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	// the slow command runs until this file exists
+	defer ioutil.WriteFile(path.Join(home, "go"), nil, 0600)
+
+	r, err := http.Get(ts.URL + "/api/v1/slow/running")
+	assert.NoError(t, err)
+	r.Body.Close()
+	get(t, ts.URL+"/api/v1/echo/aaaa")
+	time.Sleep(10 * time.Millisecond)
+	get(t, ts.URL+"/api/v1/echo/bbbb")
+	time.Sleep(10 * time.Millisecond)
+	get(t, ts.URL+"/api/v1/echo/aaaa") // bbbb is now the least recently read
+	get(t, ts.URL+"/api/v1/echo/cccc")
+	time.Sleep(10 * time.Millisecond)
+
+	r, _ = get(t, ts.URL+"/api/v1/echo/aaaa")
+	assert.Equal(t, "refurbished", r.Header.Get("Stream-Status"))
+	r, _ = get(t, ts.URL+"/api/v1/echo/cccc")
+	assert.Equal(t, "refurbished", r.Header.Get("Stream-Status"))
+
+	var storage Storage
+	_, body := get(t, ts.URL+"/api/v1/admin/storage")
+	assert.NoError(t, json.Unmarshal([]byte(body), &storage))
+	assert.Equal(t, 66, storage.Quota)
+	assert.Equal(t, 1, storage.Running)
+	assert.Equal(t, 3, storage.Runs)
+	assert.Equal(t, 66, storage.Usage)
+
+	r, _ = get(t, ts.URL+"/api/v1/echo/bbbb")
+	assert.Equal(t, "fresh", r.Header.Get("Stream-Status"))
+}
+
+func TestFresh(t *testing.T) {
+	server := NewServer()
+	err := server.Register(Command{
+		Slug:      "date",
+		Command:   "sh",
+		Arguments: []string{"-c", "date +%s%N; sleep $0", "$1"},
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	r, first := get(t, ts.URL+"/api/v1/date/0")
+	assert.Equal(t, "fresh", r.Header.Get("Stream-Status"))
+	id := r.Header.Get("X-Id")
+
+	r, body := get(t, ts.URL+"/api/v1/date/0")
+	assert.Equal(t, "refurbished", r.Header.Get("Stream-Status"))
+	assert.Equal(t, first, body)
+
+	req, err := http.NewRequest("GET", ts.URL+"/api/v1/date/0", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Cache-Control", "no-cache")
+	r, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	b, err := ioutil.ReadAll(r.Body)
+	assert.NoError(t, err)
+	r.Body.Close()
+	assert.Equal(t, "fresh", r.Header.Get("Stream-Status"))
+	assert.NotEqual(t, first, string(b))
+	assert.NotEqual(t, id, r.Header.Get("X-Id"))
+
+	_, body = get(t, ts.URL+"/api/v1/runs/"+id)
+	assert.Equal(t, first, body)
+
+	r, err = http.Post(ts.URL+"/api/v1/date/1", "", nil)
+	assert.NoError(t, err)
+	r.Body.Close()
+	assert.Equal(t, "fresh", r.Header.Get("Stream-Status"))
+	running := r.Header.Get("X-Id")
+	r, err = http.Post(ts.URL+"/api/v1/date/1", "", nil)
+	assert.NoError(t, err)
+	r.Body.Close()
+	assert.Equal(t, http.StatusConflict, r.StatusCode)
+	assert.Equal(t, running, r.Header.Get("X-Id"))
+
+	r, err = http.Post(ts.URL+"/api/v1/date/1?replace=1", "", nil)
+	assert.NoError(t, err)
+	r.Body.Close()
+	assert.Equal(t, "fresh", r.Header.Get("Stream-Status"))
+	time.Sleep(50 * time.Millisecond)
+	var status Status
+	_, body = get(t, ts.URL+"/api/v1/runs/"+running+"/status")
+	assert.NoError(t, json.Unmarshal([]byte(body), &status))
+	assert.Equal(t, "cancelled", status.Outcome)
+}
+
+func TestHistory(t *testing.T) {
+	server := NewServer()
+	err := server.Register(Command{
+		Slug:      "date",
+		Command:   "sh",
+		Arguments: []string{"-c", "echo $0; date +%s%N", "$1"},
+		History:   2,
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	r, _ := get(t, ts.URL+"/api/v1/date/a?run=previous")
+	assert.Equal(t, http.StatusNotFound, r.StatusCode)
+
+	ids := make([]string, 3)
+	outputs := make([]string, 3)
+	for i := range ids {
+		r, err := http.Post(ts.URL+"/api/v1/date/a", "", nil)
+		assert.NoError(t, err)
+		b, err := ioutil.ReadAll(r.Body)
+		assert.NoError(t, err)
+		r.Body.Close()
+		ids[i] = r.Header.Get("X-Id")
+		outputs[i] = string(b)
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	var statuses []Status
+	_, body := get(t, ts.URL+"/api/v1/date/a/history")
+	assert.NoError(t, json.Unmarshal([]byte(body), &statuses))
+	assert.Len(t, statuses, 2)
+	assert.Equal(t, ids[2], statuses[0].ID)
+	assert.Equal(t, ids[1], statuses[1].ID)
+	_, err = os.Stat(statuses[1].Path)
+	assert.NoError(t, err)
+
+	_, body = get(t, ts.URL+"/api/v1/date/a")
+	assert.Equal(t, outputs[2], body)
+	r, body = get(t, ts.URL+"/api/v1/date/a?run=previous")
+	assert.Equal(t, outputs[1], body)
+	assert.Equal(t, ids[1], r.Header.Get("X-Id"))
+	_, body = get(t, ts.URL+"/api/v1/date/a?run="+ids[1])
+	assert.Equal(t, outputs[1], body)
+	var status Status
+	_, body = get(t, ts.URL+"/api/v1/date/a/status?run=previous")
+	assert.NoError(t, json.Unmarshal([]byte(body), &status))
+	assert.Equal(t, ids[1], status.ID)
+
+	r, _ = get(t, ts.URL+"/api/v1/date/a?run="+ids[0])
+	assert.Equal(t, http.StatusNotFound, r.StatusCode)
+	r, _ = get(t, ts.URL+"/api/v1/runs/"+ids[0])
+	assert.Equal(t, http.StatusNotFound, r.StatusCode)
+}
+
+func TestDiff(t *testing.T) {
+	home, err := ioutil.TempDir(os.TempDir(), "diff_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	server := NewServer()
+	err = server.Register(Command{
+		Slug:        "cat",
+		Command:     "sh",
+		Arguments:   []string{"-c", "cat $HOME/$0", "$1"},
+		Environment: map[string]string{"HOME": home},
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	r, _ := get(t, ts.URL+"/api/v1/cat/scan/diff")
+	assert.Equal(t, http.StatusNotFound, r.StatusCode)
+
+	ids := make([]string, 0)
+	for _, content := range []string{"a\nb\nc\n", "a\nB\nc\nd\n"} {
+		assert.NoError(t, ioutil.WriteFile(path.Join(home, "scan"), []byte(content), 0600))
+		r, body := post(t, ts.URL+"/api/v1/cat/scan")
+		assert.Equal(t, content, body)
+		ids = append(ids, r.Header.Get("X-Id"))
+	}
+	time.Sleep(10 * time.Millisecond)
+
+	r, body := get(t, ts.URL+"/api/v1/cat/scan/diff")
+	assert.Equal(t, 200, r.StatusCode)
+	lines := strings.Split(body, "\n")
+	assert.True(t, strings.HasPrefix(lines[0], "--- "+ids[0]))
+	assert.True(t, strings.HasPrefix(lines[1], "+++ "+ids[1]))
+	assert.Equal(t, []string{"@@ -1,3 +1,4 @@", " a", "-b", "+B", " c", "+d", ""}, lines[2:])
+
+	_, reverse := get(t, ts.URL+"/api/v1/cat/scan/diff?from="+ids[1]+"&to="+ids[0])
+	assert.Contains(t, reverse, "-B\n+b\n")
+
+	r, _ = get(t, ts.URL+"/api/v1/cat/scan/diff?from="+uuid.New().String())
+	assert.Equal(t, http.StatusNotFound, r.StatusCode)
+}
+
+func TestRestore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "restore")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	cfg := &Config{
+		Storage: dir,
+		Commands: []Command{
+			{
+				Slug:      "echo",
+				Command:   "echo",
+				Arguments: []string{"$1"},
+			},
+		},
+	}
+	server := NewServer()
+	assert.NoError(t, server.Load(cfg))
+	ts := httptest.NewServer(server)
+	r, body := get(t, ts.URL+"/api/v1/echo/hello")
+	assert.Equal(t, "hello\n", body)
+	id := r.Header.Get("X-Id")
+	ts.Close()
+
+	// a run killed with its server
+	crashed, err := newRun(cfg.Commands[0], []string{"crash"}, dir)
+	assert.NoError(t, err)
+	_, err = crashed.Bucket.Write([]byte("cra"))
+	assert.NoError(t, err)
+
+	server = NewServer()
+	assert.NoError(t, server.Load(cfg))
+	n, err := server.Restore()
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+	ts = httptest.NewServer(server)
+	defer ts.Close()
+
+	r, body = get(t, ts.URL+"/api/v1/echo/hello")
+	assert.Equal(t, "refurbished", r.Header.Get("Stream-Status"))
+	assert.Equal(t, id, r.Header.Get("X-Id"))
+	assert.Equal(t, "hello\n", body)
+
+	var status Status
+	_, body = get(t, ts.URL+"/api/v1/runs/"+crashed.ID().String()+"/status")
+	assert.NoError(t, json.Unmarshal([]byte(body), &status))
+	assert.Equal(t, "interrupted", status.Outcome)
+	assert.Equal(t, 3, status.Length)
+
+	r, body = get(t, ts.URL+"/api/v1/echo/crash")
+	assert.Equal(t, "refurbished", r.Header.Get("Stream-Status"))
+	assert.Equal(t, "interrupted", r.Header.Get("Stream-Outcome"))
+	assert.Equal(t, "cra", body)
+}
+
+func getRange(t *testing.T, url, rang string) (*http.Response, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	assert.NoError(t, err)
+	req.Header.Set("Range", rang)
+	r, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	assert.NoError(t, err)
+	return r, string(body)
+}
+
+func TestRange(t *testing.T) {
+	home, err := ioutil.TempDir(os.TempDir(), "range_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	server := NewServer()
+	err = server.Register(Command{
+		Slug:        "slow",
+		Command:     "sh",
+		Arguments:   []string{"-c", "echo $0; while [ ! -e $HOME/go ]; do sleep 0.01; done; echo end", "$1"},
+		Environment: map[string]string{"HOME": home},
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	// the slow command runs until this file exists
+	marker := path.Join(home, "go")
+	defer ioutil.WriteFile(marker, nil, 0600)
+
+	// the end of the range is written before the end of the run
+	r, body := getRange(t, ts.URL+"/api/v1/slow/abcdef", "bytes=1-3")
+	assert.Equal(t, http.StatusPartialContent, r.StatusCode)
+	assert.Equal(t, "bytes 1-3/*", r.Header.Get("Content-Range"))
+	assert.Equal(t, "bcd", body)
+
+	// without the outcome of the run
+	r, body = getRange(t, ts.URL+"/api/v1/slow/abcdef", "bytes=0-2")
+	assert.Equal(t, http.StatusPartialContent, r.StatusCode)
+	assert.Equal(t, "abc", body)
+	assert.Equal(t, "", r.Header.Get("Trailer"))
+	assert.Equal(t, 0, len(r.Trailer))
+
+	r, _ = getRange(t, ts.URL+"/api/v1/slow/abcdef", "bytes=-4")
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, r.StatusCode)
+	assert.Equal(t, "", r.Header.Get("Content-Range"))
+
+	// an open range of a running output has no length to give
+	req, err := http.NewRequest("GET", ts.URL+"/api/v1/slow/abcdef", nil)
+	assert.NoError(t, err)
+	req.Header.Set("Range", "bytes=7-")
+	r, err = http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, r.StatusCode)
+	assert.Equal(t, "", r.Header.Get("Content-Range"))
+	assert.NoError(t, ioutil.WriteFile(marker, nil, 0600))
+	raw, err := ioutil.ReadAll(r.Body)
+	assert.NoError(t, err)
+	r.Body.Close()
+	assert.Equal(t, "end\n", string(raw))
+	assert.Equal(t, "success", r.Trailer.Get("Stream-Outcome"))
+
+	// the output is closed at the end of the open range
+	r, body = getRange(t, ts.URL+"/api/v1/slow/abcdef", "bytes=2-4")
+	assert.Equal(t, http.StatusPartialContent, r.StatusCode)
+	assert.Equal(t, "bytes 2-4/11", r.Header.Get("Content-Range"))
+	assert.Equal(t, "3", r.Header.Get("Content-Length"))
+	assert.Equal(t, "cde", body)
+
+	r, body = getRange(t, ts.URL+"/api/v1/slow/abcdef", "bytes=-4")
+	assert.Equal(t, http.StatusPartialContent, r.StatusCode)
+	assert.Equal(t, "bytes 7-10/11", r.Header.Get("Content-Range"))
+	assert.Equal(t, "end\n", body)
+
+	r, body = getRange(t, ts.URL+"/api/v1/slow/abcdef", "bytes=5-100")
+	assert.Equal(t, "bytes 5-10/11", r.Header.Get("Content-Range"))
+	assert.Equal(t, "f\nend\n", body)
+
+	r, _ = getRange(t, ts.URL+"/api/v1/slow/abcdef", "bytes=11-")
+	assert.Equal(t, http.StatusRequestedRangeNotSatisfiable, r.StatusCode)
+	assert.Equal(t, "bytes */11", r.Header.Get("Content-Range"))
+
+	r, _ = getRange(t, ts.URL+"/api/v1/slow/abcdef", "bytes=4-2")
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+
+	// an unknown unit is ignored
+	r, body = getRange(t, ts.URL+"/api/v1/slow/abcdef", "octets=1-2")
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, "abcdef\nend\n", body)
+
+	// overlapping ranges are coalesced
+	r, body = getRange(t, ts.URL+"/api/v1/slow/abcdef", "bytes=3-5,0-1,2-3")
+	assert.Equal(t, http.StatusPartialContent, r.StatusCode)
+	assert.Equal(t, "bytes 0-5/11", r.Header.Get("Content-Range"))
+	assert.Equal(t, "abcdef", body)
+}
+
+func TestMultipartRange(t *testing.T) {
+	server := NewServer()
+	err := server.Register(Command{
+		Slug:      "echo",
+		Command:   "echo",
+		Arguments: []string{"$1"},
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	get(t, ts.URL+"/api/v1/echo/abcdefghij")
+	r, body := getRange(t, ts.URL+"/api/v1/echo/abcdefghij", "bytes=-2,0-1,1-2,6-8")
+	assert.Equal(t, http.StatusPartialContent, r.StatusCode)
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	reader := multipart.NewReader(strings.NewReader(body), params["boundary"])
+	for _, want := range []struct {
+		rang string
+		body string
+	}{
+		{"bytes 0-2/11", "abc"},
+		{"bytes 6-10/11", "ghij\n"},
+	} {
+		part, err := reader.NextPart()
+		assert.NoError(t, err)
+		assert.Equal(t, "text/plain", part.Header.Get("Content-Type"))
+		assert.Equal(t, want.rang, part.Header.Get("Content-Range"))
+		b, err := ioutil.ReadAll(part)
+		assert.NoError(t, err)
+		assert.Equal(t, want.body, string(b))
+	}
+	_, err = reader.NextPart()
+	assert.Equal(t, io.EOF, err)
+}
+
+func getWith(t *testing.T, url string, headers map[string]string) (*http.Response, string) {
+	req, err := http.NewRequest("GET", url, nil)
+	assert.NoError(t, err)
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	r, err := http.DefaultClient.Do(req)
+	assert.NoError(t, err)
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	assert.NoError(t, err)
+	return r, string(body)
+}
+
+func TestConditional(t *testing.T) {
+	server := NewServer()
+	err := server.Register(Command{
+		Slug:      "date",
+		Command:   "sh",
+		Arguments: []string{"-c", "echo $0; date +%N", "$1"},
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	url := ts.URL + "/api/v1/date/now"
+
+	get(t, url)
+	r, body := get(t, url)
+	tag := r.Header.Get("ETag")
+	assert.Regexp(t, `^"[0-9a-f]{64}"$`, tag)
+
+	r, body = getWith(t, url, map[string]string{"If-None-Match": `"nope", W/` + tag})
+	assert.Equal(t, http.StatusNotModified, r.StatusCode)
+	assert.Equal(t, tag, r.Header.Get("ETag"))
+	assert.Equal(t, "", body)
+
+	r, _ = getWith(t, url, map[string]string{"If-None-Match": `"nope"`})
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+
+	r, _ = getWith(t, url, map[string]string{"If-Match": tag})
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	r, _ = getWith(t, url, map[string]string{"If-Match": "W/" + tag})
+	assert.Equal(t, http.StatusPreconditionFailed, r.StatusCode)
+
+	r, body = getWith(t, url, map[string]string{"Range": "bytes=0-2", "If-Range": tag})
+	assert.Equal(t, http.StatusPartialContent, r.StatusCode)
+	assert.Equal(t, "now", body)
+
+	// the run is replaced, the resumed download gets the new output
+	post(t, url)
+	time.Sleep(50 * time.Millisecond)
+	r, body = getWith(t, url, map[string]string{"Range": "bytes=0-2", "If-Range": tag})
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.True(t, strings.HasPrefix(body, "now\n"))
+	assert.NotEqual(t, tag, r.Header.Get("ETag"))
+}
+
+func head(t *testing.T, url string) *http.Response {
+	r, err := http.Head(url)
+	assert.NoError(t, err)
+	r.Body.Close()
+	return r
+}
+
+func TestHead(t *testing.T) {
+	home, err := ioutil.TempDir(os.TempDir(), "head_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	server := NewServer()
+	err = server.Register(Command{
+		Slug:        "slow",
+		Command:     "sh",
+		Arguments:   []string{"-c", "echo $0; while [ ! -e $HOME/go ]; do sleep 0.01; done", "$1"},
+		Environment: map[string]string{"HOME": home},
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	// the slow command runs until this file exists
+	marker := path.Join(home, "go")
+	defer ioutil.WriteFile(marker, nil, 0600)
+
+	r := head(t, ts.URL+"/api/v1/slow/hello")
+	assert.Equal(t, http.StatusNotFound, r.StatusCode)
+	assert.Equal(t, 0, len(server.runs.list()))
+
+	// the headers of a running output are sent at once
+	running, err := http.Get(ts.URL + "/api/v1/slow/hello")
+	assert.NoError(t, err)
+	defer running.Body.Close()
+	r = head(t, ts.URL+"/api/v1/slow/hello")
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, "refurbished", r.Header.Get("Stream-Status"))
+	assert.Equal(t, "running", r.Header.Get("Stream-State"))
+	assert.Equal(t, "", r.Header.Get("ETag"))
+	id := r.Header.Get("X-Id")
+	assert.NotEqual(t, "", id)
+
+	// the output is closed once the run is finished
+	assert.NoError(t, ioutil.WriteFile(marker, nil, 0600))
+	_, err = ioutil.ReadAll(running.Body)
+	assert.NoError(t, err)
+	r = head(t, ts.URL+"/api/v1/slow/hello")
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, "finished", r.Header.Get("Stream-State"))
+	assert.Equal(t, "6", r.Header.Get("Content-Length"))
+	assert.Equal(t, id, r.Header.Get("X-Id"))
+	assert.NotEqual(t, "", r.Header.Get("ETag"))
+	assert.Equal(t, "success", r.Header.Get("Stream-Outcome"))
+
+	r = head(t, ts.URL+"/api/v1/runs/"+id+"/stderr")
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, "0", r.Header.Get("Content-Length"))
+	assert.Equal(t, 1, len(server.runs.list()))
+}
+
+func TestAsync(t *testing.T) {
+	home, err := ioutil.TempDir(os.TempDir(), "async_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	server := NewServer()
+	err = server.Register(Command{
+		Slug:        "slow",
+		Command:     "sh",
+		Arguments:   []string{"-c", "echo $0; while [ ! -e $HOME/go ]; do sleep 0.01; done; echo end", "$1"},
+		Environment: map[string]string{"HOME": home},
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	// the command runs until this file exists
+	defer ioutil.WriteFile(path.Join(home, "go"), nil, 0600)
+
+	// the answer comes while the command is still running
+	r, body := post(t, ts.URL+"/api/v1/slow/hello?async=1")
+	assert.Equal(t, http.StatusAccepted, r.StatusCode)
+	assert.Equal(t, "fresh", r.Header.Get("Stream-Status"))
+	assert.NotContains(t, body, "hello")
+	var accepted Accepted
+	assert.NoError(t, json.Unmarshal([]byte(body), &accepted))
+	assert.Equal(t, r.Header.Get("X-Id"), accepted.ID)
+	assert.Equal(t, "/api/v1/runs/"+accepted.ID, r.Header.Get("Location"))
+	assert.Equal(t, accepted.Location, r.Header.Get("Location"))
+
+	var status Status
+	_, body = get(t, ts.URL+accepted.Status)
+	assert.NoError(t, json.Unmarshal([]byte(body), &status))
+	assert.Equal(t, "running", status.State)
+
+	assert.NoError(t, ioutil.WriteFile(path.Join(home, "go"), nil, 0600))
+	r, body = get(t, ts.URL+accepted.Location)
+	assert.Equal(t, http.StatusOK, r.StatusCode)
+	assert.Equal(t, "hello\nend\n", body)
+}
+
+func TestWebhook(t *testing.T) {
+	defer func(backoff time.Duration) { webhookBackoff = backoff }(webhookBackoff)
+	webhookBackoff = 10 * time.Millisecond
+	payloads := make(chan WebhookPayload, 10)
+	calls := 0
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 { // the first delivery fails
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var payload WebhookPayload
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		payloads <- payload
+	}))
+	defer receiver.Close()
+
+	server := NewServer()
+	err := server.Register(Command{
+		Slug:         "echo",
+		Command:      "echo",
+		Arguments:    []string{"$1"},
+		Webhook:      receiver.URL,
+		WebhookHosts: []string{"127.0.0.1"},
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	r, _ := get(t, ts.URL+"/api/v1/echo/hello")
+	id := r.Header.Get("X-Id")
+	payload := <-payloads
+	assert.Equal(t, id, payload.ID)
+	assert.Equal(t, []string{"echo", "hello"}, payload.Argv)
+	assert.Equal(t, "success", payload.Outcome)
+	assert.Equal(t, 0, payload.ExitCode)
+	assert.Equal(t, 6, payload.Length)
+	assert.Equal(t, "5891b5b522d5df086d0ff0b110fbd9d21bb4fc7163af34d08286a2e846f6be03", payload.Sha256)
+
+	time.Sleep(10 * time.Millisecond)
+	var status Status
+	_, body := get(t, ts.URL+"/api/v1/runs/"+id+"/status")
+	assert.NoError(t, json.Unmarshal([]byte(body), &status))
+	assert.Equal(t, receiver.URL, status.Webhook.URL)
+	assert.Equal(t, 2, status.Webhook.Attempts)
+	assert.True(t, status.Webhook.Delivered)
+	assert.Equal(t, 200, status.Webhook.StatusCode)
+
+	// the request names its own webhook
+	other := make(chan WebhookPayload, 1)
+	receiver2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var payload WebhookPayload
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&payload))
+		other <- payload
+	}))
+	defer receiver2.Close()
+	r, _ = post(t, ts.URL+"/api/v1/echo/world?webhook="+receiver2.URL)
+	assert.Equal(t, r.Header.Get("X-Id"), (<-other).ID)
+
+	r, _ = post(t, ts.URL+"/api/v1/echo/world?webhook=nope")
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	r, _ = post(t, ts.URL+"/api/v1/echo/world?webhook=http://169.254.169.254/latest")
+	assert.Equal(t, http.StatusForbidden, r.StatusCode)
+}
+
+func TestEvents(t *testing.T) {
+	defer func(interval time.Duration) { sseHeartbeat = interval }(sseHeartbeat)
+	sseHeartbeat = 50 * time.Millisecond
+	server := NewServer()
+	err := server.Register(Command{
+		Slug:      "slow",
+		Command:   "sh",
+		Arguments: []string{"-c", "echo $0; sleep 0.2; printf 'end'", "$1"},
+	})
+	assert.NoError(t, err)
+	err = server.Register(Command{
+		Slug:      "progress",
+		Command:   "sh",
+		Arguments: []string{"-c", `printf '10%%\r50%%\r100%%\r\n'; echo $0`, "$1"},
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	accept := map[string]string{"Accept": "text/event-stream"}
+	r, body := getWith(t, ts.URL+"/api/v1/slow/hello", accept)
+	assert.Equal(t, "text/event-stream", r.Header.Get("Content-Type"))
+	assert.Contains(t, body, ": heartbeat\n\n")
+	body = strings.ReplaceAll(body, ": heartbeat\n\n", "")
+	assert.True(t, strings.HasPrefix(body, "id: 6\ndata: hello\n\n"))
+	assert.Contains(t, body, "id: 9\ndata: end\n\nevent: exit\ndata: {")
+
+	i := strings.Index(body, "event: exit\ndata: ")
+	assert.True(t, strings.HasSuffix(body, "}\n\n"))
+	var status Status
+	assert.NoError(t, json.Unmarshal([]byte(strings.TrimSpace(body[i+18:])), &status))
+	assert.Equal(t, "success", status.Outcome)
+	assert.Equal(t, 0, *status.ExitCode)
+
+	accept["Last-Event-ID"] = "6"
+	_, body = getWith(t, ts.URL+"/api/v1/slow/hello", accept)
+	body = strings.ReplaceAll(body, ": heartbeat\n\n", "")
+	assert.True(t, strings.HasPrefix(body, "id: 9\ndata: end\n\nevent: exit\n"))
+
+	// heartbeats racing with the end of finished streams
+	sseHeartbeat = time.Millisecond
+	for i := 0; i < 50; i++ {
+		_, body = getWith(t, ts.URL+"/api/v1/slow/hello", accept)
+		assert.Contains(t, body, "event: exit\n")
+	}
+
+	// each segment of a progress bar is a data line
+	delete(accept, "Last-Event-ID")
+	_, body = getWith(t, ts.URL+"/api/v1/progress/done", accept)
+	body = strings.ReplaceAll(body, ": heartbeat\n\n", "")
+	assert.True(t, strings.HasPrefix(body,
+		"id: 14\ndata: 10%\ndata: 50%\ndata: 100%\n\nid: 19\ndata: done\n\nevent: exit\n"))
+}
+
+func TestWebSocket(t *testing.T) {
+	server := NewServer()
+	err := server.Register(Command{
+		Slug:      "loop",
+		Command:   "sh",
+		Arguments: []string{"-c", "trap 'echo usr1' USR1; echo $0; while true; do sleep 0.01; done", "$1"},
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	// without the upgrade, nothing is started
+	r, err := http.Get(ts.URL + "/api/v1/loop/hello/ws")
+	assert.NoError(t, err)
+	r.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+	assert.Equal(t, 0, len(server.runs.list()))
+
+	conn, r, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(ts.URL, "http")+"/api/v1/loop/hello/ws", nil)
+	assert.NoError(t, err)
+	defer conn.Close()
+	id := r.Header.Get("X-Id")
+	assert.NotEqual(t, "", id)
+	r, err = http.Head(ts.URL + "/api/v1/runs/" + id + "/ws")
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, r.StatusCode)
+
+	type message struct {
+		binary bool
+		data   string
+	}
+	messages := make(chan message, 10)
+	go func() {
+		defer close(messages)
+		for {
+			kind, data, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			messages <- message{kind == websocket.BinaryMessage, string(data)}
+		}
+	}()
+	next := func() message {
+		select {
+		case m := <-messages:
+			return m
+		case <-time.After(time.Second):
+			t.Fatal("no message")
+		}
+		return message{}
+	}
+	event := func(m message) Event {
+		assert.False(t, m.binary)
+		var e Event
+		assert.NoError(t, json.Unmarshal([]byte(m.data), &e))
+		return e
+	}
+
+	assert.Equal(t, message{true, "hello\n"}, next())
+
+	assert.NoError(t, conn.WriteJSON(Control{Action: "pause"}))
+	assert.Equal(t, "ack", event(next()).Event)
+	assert.NoError(t, conn.WriteJSON(Control{Action: "signal", Signal: "SIGUSR1"}))
+	assert.Equal(t, Event{Event: "ack", Action: "signal"}, event(next()))
+	select {
+	case m := <-messages:
+		t.Fatal("paused", m)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.NoError(t, conn.WriteJSON(Control{Action: "resume"}))
+	messagesAfterResume := []message{next(), next()}
+	assert.Contains(t, messagesAfterResume, message{true, "usr1\n"})
+
+	assert.NoError(t, conn.WriteJSON(Control{Action: "signal", Signal: "BOOM"}))
+	e := event(next())
+	assert.Equal(t, "error", e.Event)
+	assert.Equal(t, "Unknown signal : BOOM", e.Error)
+
+	assert.NoError(t, conn.WriteJSON(Control{Action: "cancel"}))
+	assert.Equal(t, "ack", event(next()).Event)
+	e = event(next())
+	assert.Equal(t, "exit", e.Event)
+	assert.Equal(t, id, e.Status.ID)
+	assert.Equal(t, "cancelled", e.Status.Outcome)
+	_, ok := <-messages
+	assert.False(t, ok)
+
+	// late reader, from an offset
+	conn2, _, err := websocket.DefaultDialer.Dial(
+		"ws"+strings.TrimPrefix(ts.URL, "http")+"/api/v1/runs/"+id+"/ws?offset=6", nil)
+	assert.NoError(t, err)
+	defer conn2.Close()
+	_, data, err := conn2.ReadMessage()
+	assert.NoError(t, err)
+	assert.Equal(t, "usr1\n", string(data))
+}
+
+func TestLines(t *testing.T) {
+	server := NewServer()
+	err := server.Register(Command{
+		Slug:      "lines",
+		Command:   "sh",
+		Arguments: []string{"-c", "echo $0; sleep 0.2; printf 'b\\n\\377\\nc'", "$1"},
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	get(t, ts.URL+"/api/v1/lines/a")
+	// a late reader sees the real timing
+	r, body := getWith(t, ts.URL+"/api/v1/lines/a", map[string]string{"Accept": "application/x-ndjson"})
+	assert.Equal(t, "application/x-ndjson", r.Header.Get("Content-Type"))
+	assert.Equal(t, "success", r.Trailer.Get("Stream-Outcome"))
+	lines := make([]Line, 0)
+	decoder := json.NewDecoder(strings.NewReader(body))
+	for decoder.More() {
+		var line Line
+		assert.NoError(t, decoder.Decode(&line))
+		lines = append(lines, line)
+	}
+	assert.Equal(t, 4, len(lines))
+	assert.True(t, lines[1].Time.Sub(lines[0].Time) >= 150*time.Millisecond)
+	assert.True(t, lines[2].Time.Sub(lines[1].Time) < 50*time.Millisecond)
+	for i, want := range []Line{
+		{Offset: 0, Line: 1, Text: "a"},
+		{Offset: 2, Line: 2, Text: "b"},
+		{Offset: 4, Line: 3, Text: "/w==", Encoding: "base64"},
+		{Offset: 6, Line: 4, Text: "c"},
+	} {
+		assert.False(t, lines[i].Time.IsZero())
+		lines[i].Time = time.Time{}
+		want.Time = time.Time{}
+		assert.Equal(t, want, lines[i])
+	}
+}
+
+func TestDropWithReader(t *testing.T) {
+	server := NewServer()
+	err := server.Register(Command{
+		Slug:      "echo",
+		Command:   "echo",
+		Arguments: []string{"$1"},
+		History:   1,
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	r, _ := get(t, ts.URL+"/api/v1/echo/hello")
+	id, err := uuid.Parse(r.Header.Get("X-Id"))
+	assert.NoError(t, err)
+	old, ok := server.runs.get(id)
+	assert.True(t, ok)
+	atomic.AddInt32(&old.readers, 1) // a slow reader
+
+	post(t, ts.URL+"/api/v1/echo/hello")
+	time.Sleep(10 * time.Millisecond)
+	_, ok = server.runs.get(id)
+	assert.True(t, ok)
+	_, err = os.Stat(old.Bucket.Path())
+	assert.NoError(t, err)
+
+	old.release()
+	_, ok = server.runs.get(id)
+	assert.False(t, ok)
+	_, err = os.Stat(old.Bucket.Path())
+	assert.True(t, os.IsNotExist(err))
+	_, err = os.Stat(old.Stderr.Path())
+	assert.True(t, os.IsNotExist(err))
+}
@@ -0,0 +1,62 @@
+package api
+
+import (
+	"encoding/hex"
+	"net/http"
+	"strings"
+
+	"github.com/factorysh/stream_my_command/stream"
+)
+
+// etag is the strong ETag of a finished bucket
+func etag(bucket *stream.Bucket) string {
+	return `"` + hex.EncodeToString(bucket.Hash()) + `"`
+}
+
+// etagMatch says if an ETag is in the list of a conditional header.
+// Weak ETags never match with a strong comparison. An empty ETag, for a
+// running output, only matches "*".
+func etagMatch(list, tag string, strong bool) bool {
+	for _, candidate := range strings.Split(list, ",") {
+		candidate = strings.TrimSpace(candidate)
+		if candidate == "*" {
+			return true
+		}
+		if tag == "" {
+			continue
+		}
+		if strings.HasPrefix(candidate, "W/") {
+			if strong {
+				continue
+			}
+			candidate = candidate[2:]
+		}
+		if candidate == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// checkConditions evaluates If-Match and If-None-Match against the ETag of
+// an output, empty for a running output. It returns the status to answer,
+// 0 when the request can be served.
+func checkConditions(req *http.Request, tag string) int {
+	if ifMatch := req.Header.Get("If-Match"); ifMatch != "" && !etagMatch(ifMatch, tag, true) {
+		return http.StatusPreconditionFailed
+	}
+	if ifNoneMatch := req.Header.Get("If-None-Match"); ifNoneMatch != "" && etagMatch(ifNoneMatch, tag, false) {
+		if req.Method == "GET" || req.Method == "HEAD" {
+			return http.StatusNotModified
+		}
+		return http.StatusPreconditionFailed
+	}
+	return 0
+}
+
+// rangeApplies says if the Range header must be used : If-Range needs
+// the current strong ETag, otherwise the whole output is sent
+func rangeApplies(req *http.Request, tag string) bool {
+	ifRange := req.Header.Get("If-Range")
+	return ifRange == "" || (tag != "" && ifRange == tag)
+}
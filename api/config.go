@@ -0,0 +1,140 @@
+package api
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"regexp"
+	"strings"
+
+	_command "github.com/factorysh/stream_my_command/command"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	slugReg *regexp.Regexp
+	envReg  *regexp.Regexp
+)
+
+// reservedSlugs are used by the Server
+var reservedSlugs = map[string]interface{}{
+	"runs":  new(interface{}),
+	"admin": new(interface{}),
+}
+
+func init() {
+	slugReg = regexp.MustCompile(`^[a-zA-Z0-9_.-]+$`)
+	envReg = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z_0-9]*$`)
+}
+
+// Config declares the exposed commands
+type Config struct {
+	Concurrency int       `yaml:"concurrency"`
+	Quota       int       `yaml:"quota"`
+	Storage     string    `yaml:"storage"`
+	Commands    []Command `yaml:"commands"`
+}
+
+// ReadConfig reads a YAML config file. JSON is YAML too.
+func ReadConfig(path string) (*Config, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	cfg, err := ParseConfig(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s : %v", path, err)
+	}
+	return cfg, nil
+}
+
+// ParseConfig parses and validates a config
+func ParseConfig(r io.Reader) (*Config, error) {
+	cfg := &Config{}
+	decoder := yaml.NewDecoder(r)
+	decoder.KnownFields(true)
+	err := decoder.Decode(cfg)
+	if err == io.EOF {
+		return nil, fmt.Errorf("Empty config")
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = cfg.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// Validate all commands, slugs must be unique
+func (c *Config) Validate() error {
+	if c.Concurrency < 0 {
+		return fmt.Errorf("Negative concurrency : %d", c.Concurrency)
+	}
+	if c.Quota < 0 {
+		return fmt.Errorf("Negative quota : %d", c.Quota)
+	}
+	if len(c.Commands) == 0 {
+		return fmt.Errorf("No commands")
+	}
+	slugs := make(map[string]interface{})
+	for i, command := range c.Commands {
+		err := command.Validate()
+		if err != nil {
+			return fmt.Errorf("Command #%d : %v", i+1, err)
+		}
+		if _, ok := slugs[command.Slug]; ok {
+			return fmt.Errorf("Command #%d : duplicated slug %s", i+1, command.Slug)
+		}
+		slugs[command.Slug] = new(interface{})
+	}
+	return nil
+}
+
+// Validate a command
+func (c *Command) Validate() error {
+	if c.Slug == "" {
+		return fmt.Errorf("Empty slug")
+	}
+	if !slugReg.MatchString(c.Slug) {
+		return fmt.Errorf("Bad slug : %s", c.Slug)
+	}
+	if _, ok := reservedSlugs[c.Slug]; ok {
+		return fmt.Errorf("Reserved slug : %s", c.Slug)
+	}
+	if c.Command == "" {
+		return fmt.Errorf("Empty command for %s", c.Slug)
+	}
+	_, err := _command.NewArguments(c.Arguments...)
+	if err != nil {
+		return fmt.Errorf("Bad arguments for %s : %v", c.Slug, err)
+	}
+	if c.Concurrency < 0 {
+		return fmt.Errorf("Negative concurrency for %s : %d", c.Slug, c.Concurrency)
+	}
+	if c.History < 0 {
+		return fmt.Errorf("Negative history for %s : %d", c.Slug, c.History)
+	}
+	if c.MaxDuration < 0 || c.GracePeriod < 0 || c.TTL < 0 {
+		return fmt.Errorf("Negative duration for %s", c.Slug)
+	}
+	if c.Webhook != "" {
+		err = validateWebhook(c.Webhook)
+		if err != nil {
+			return fmt.Errorf("Bad webhook for %s : %v", c.Slug, err)
+		}
+	}
+	for _, host := range c.WebhookHosts {
+		if host == "" || strings.ContainsAny(host, "/:") {
+			return fmt.Errorf("Bad webhook host for %s : %s", c.Slug, host)
+		}
+	}
+	for k := range c.Environment {
+		if !envReg.MatchString(k) {
+			return fmt.Errorf("Bad environment key for %s : %s", c.Slug, k)
+		}
+	}
+	return nil
+}
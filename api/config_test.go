@@ -0,0 +1,56 @@
+package api
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseConfig(t *testing.T) {
+	cfg, err := ParseConfig(strings.NewReader(`
+commands:
+  - slug: nmap
+    command: nmap
+    arguments: ["-A", "-T4", "-oX", "-", "$1"]
+    content_type: application/xml
+  - slug: ping
+    command: ping
+    arguments: ["-c", "3", "$1"]
+    environment:
+      LANG: C
+`))
+	assert.NoError(t, err)
+	assert.Len(t, cfg.Commands, 2)
+	assert.Equal(t, "application/xml", cfg.Commands[0].ContentType)
+	assert.Equal(t, []string{"-c", "3", "$1"}, cfg.Commands[1].Arguments)
+	assert.Equal(t, "C", cfg.Commands[1].Environment["LANG"])
+}
+
+func TestParseJSONConfig(t *testing.T) {
+	cfg, err := ParseConfig(strings.NewReader(`
+{"commands": [{"slug": "nmap", "command": "nmap", "arguments": ["$1"]}]}
+`))
+	assert.NoError(t, err)
+	assert.Len(t, cfg.Commands, 1)
+	assert.Equal(t, "nmap", cfg.Commands[0].Slug)
+}
+
+func TestBadConfig(t *testing.T) {
+	for _, raw := range []string{
+		``,
+		`commands: []`,
+		`commands: [{slug: nmap}]`,
+		`commands: [{command: nmap}]`,
+		`commands: [{slug: "n/map", command: nmap}]`,
+		`commands: [{slug: runs, command: nmap}]`,
+		`commands: [{slug: nmap, command: nmap, unknown: 42}]`,
+		`commands: [{slug: nmap, command: nmap, environment: {"1BAD": a}}]`,
+		`commands: [{slug: nmap, command: nmap, webhook: "ftp://example.com"}]`,
+		`commands: [{slug: nmap, command: nmap, webhook_hosts: ["http://example.com"]}]`,
+		`commands: [{slug: nmap, command: nmap}, {slug: nmap, command: nmap}]`,
+	} {
+		_, err := ParseConfig(strings.NewReader(raw))
+		assert.Error(t, err, raw)
+	}
+}
@@ -0,0 +1,75 @@
+package api
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+
+	_command "github.com/factorysh/stream_my_command/command"
+	"github.com/pmezard/go-difflib/difflib"
+)
+
+// serveDiff writes an unified diff between two finished runs of the history.
+// Runs are "previous", "" for the current one, or an ID.
+// By default, from the previous run, to the current run.
+func (h *handler) serveDiff(w http.ResponseWriter, r *http.Request, k string) {
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	from := r.URL.Query().Get("from")
+	if from == "" {
+		from = "previous"
+	}
+	to := r.URL.Query().Get("to")
+	runs := make([]*Run, 2)
+	texts := make([][]string, 2)
+	for i, which := range []string{from, to} {
+		run, ok := h.lookup(k, which)
+		if !ok {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		if run.State() != _command.Finished {
+			w.Header().Set("X-Id", run.ID().String())
+			w.WriteHeader(http.StatusConflict)
+			return
+		}
+		buff := &bytes.Buffer{}
+		err := run.Copy(run.Bucket, 0, -1, buff)
+		if err != nil {
+			fmt.Println("error", err)
+			w.WriteHeader(500)
+			return
+		}
+		runs[i] = run
+		texts[i] = splitLines(buff.String())
+	}
+	w.Header().Set("Content-Type", "text/x-diff")
+	err := difflib.WriteUnifiedDiff(w, difflib.UnifiedDiff{
+		A:        texts[0],
+		B:        texts[1],
+		FromFile: runs[0].ID().String(),
+		FromDate: runs[0].Job.Ended().String(),
+		ToFile:   runs[1].ID().String(),
+		ToDate:   runs[1].Job.Ended().String(),
+		Context:  3,
+	})
+	if err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+// splitLines keeps the line endings, the last line always ends with one
+func splitLines(txt string) []string {
+	if txt == "" {
+		return []string{}
+	}
+	lines := strings.SplitAfter(txt, "\n")
+	if lines[len(lines)-1] == "" {
+		return lines[:len(lines)-1]
+	}
+	lines[len(lines)-1] += "\n"
+	return lines
+}
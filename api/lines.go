@@ -0,0 +1,40 @@
+package api
+
+import (
+	"bytes"
+)
+
+// lineSplitter cuts an output in lines, with their offsets
+type lineSplitter struct {
+	offset  int // of the end of pending
+	pending []byte
+}
+
+// split calls line for each complete line of p, with the offsets of its
+// start and of its end, after the line feed
+func (l *lineSplitter) split(p []byte, line func(line []byte, start, end int) error) error {
+	l.pending = append(l.pending, p...)
+	l.offset += len(p)
+	for {
+		i := bytes.IndexByte(l.pending, '\n')
+		if i < 0 {
+			return nil
+		}
+		start := l.offset - len(l.pending)
+		err := line(l.pending[:i], start, start+i+1)
+		if err != nil {
+			return err
+		}
+		l.pending = l.pending[i+1:]
+	}
+}
+
+// rest calls line for the last line, without line feed
+func (l *lineSplitter) rest(line func(line []byte, start, end int) error) error {
+	if len(l.pending) == 0 {
+		return nil
+	}
+	err := line(l.pending, l.offset-len(l.pending), l.offset)
+	l.pending = nil
+	return err
+}
@@ -0,0 +1,94 @@
+package api
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/factorysh/stream_my_command/stream"
+)
+
+// wantsLines says if the client asks for NDJSON lines
+func wantsLines(r *http.Request) bool {
+	return r.Method == "GET" &&
+		strings.Contains(r.Header.Get("Accept"), "application/x-ndjson")
+}
+
+// Line of an output, with the time it was written
+type Line struct {
+	Offset   int       `json:"offset"`
+	Line     int       `json:"line"`
+	Time     time.Time `json:"time"`
+	Text     string    `json:"text"`
+	Encoding string    `json:"encoding,omitempty"`
+}
+
+// lineEncoder writes an output as NDJSON, one object per line
+type lineEncoder struct {
+	w       io.Writer
+	encoder *json.Encoder
+	stamps  *stream.Stamps
+	lines   *lineSplitter
+	n       int
+}
+
+func newLineEncoder(w io.Writer, bucket *stream.Bucket) *lineEncoder {
+	return &lineEncoder{
+		w:       w,
+		encoder: json.NewEncoder(w),
+		stamps:  bucket.Stamps(),
+		lines:   &lineSplitter{},
+	}
+}
+
+// line encodes a line, its time is the write time of its last byte
+func (l *lineEncoder) line(line []byte, start, end int) error {
+	l.n++
+	out := &Line{
+		Offset: start,
+		Line:   l.n,
+		Time:   l.stamps.At(end - 1),
+	}
+	if utf8.Valid(line) {
+		out.Text = string(line)
+	} else {
+		out.Text = base64.StdEncoding.EncodeToString(line)
+		out.Encoding = "base64"
+	}
+	return l.encoder.Encode(out)
+}
+
+func (l *lineEncoder) Write(p []byte) (int, error) {
+	err := l.lines.split(p, l.line)
+	if err != nil {
+		return 0, err
+	}
+	if f, ok := l.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return len(p), nil
+}
+
+// serveLines streams an output as NDJSON lines, the outcome is in the trailers
+func (r *Run) serveLines(w http.ResponseWriter, bucket *stream.Bucket) {
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.Header().Set("Trailer", strings.Join(outcomeHeaders, ", "))
+	w.Header().Set("X-Id", r.ID().String())
+	w.WriteHeader(http.StatusOK)
+	encoder := newLineEncoder(w, bucket)
+	defer encoder.stamps.Close()
+	err := r.Copy(bucket, 0, -1, encoder)
+	if err == nil {
+		err = encoder.lines.rest(encoder.line)
+	}
+	if err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	r.setOutcome(w.Header(), bucket)
+}
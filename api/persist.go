@@ -0,0 +1,136 @@
+package api
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	_command "github.com/factorysh/stream_my_command/command"
+	"github.com/factorysh/stream_my_command/stream"
+)
+
+// runMetadata is written in the manifest of the STDOUT bucket of a run
+type runMetadata struct {
+	Slug        string        `json:"slug"`
+	Command     string        `json:"command"`
+	Arguments   []string      `json:"arguments"`
+	ContentType string        `json:"content_type"`
+	Stderr      string        `json:"stderr"`
+	TTL         time.Duration `json:"ttl"`
+	Created     time.Time     `json:"created"`
+	Outcome     string        `json:"outcome,omitempty"`
+	ExitCode    int           `json:"exit_code"`
+	Started     time.Time     `json:"started"`
+	Ended       time.Time     `json:"ended"`
+}
+
+// save the run in the manifest of its STDOUT bucket
+func (r *Run) save() error {
+	return r.Bucket.SetMetadata(&runMetadata{
+		Slug:        r.Slug,
+		Command:     r.Job.Name,
+		Arguments:   r.Job.Args,
+		ContentType: r.ContentType,
+		Stderr:      r.Stderr.Path(),
+		TTL:         r.ttl,
+		Created:     r.created,
+		Outcome:     string(r.Job.Outcome()),
+		ExitCode:    r.Job.ExitCode(),
+		Started:     r.Job.Started(),
+		Ended:       r.Job.Ended(),
+	})
+}
+
+// restoreRun reopens a run saved in a bucket folder, nil if the bucket
+// is not the STDOUT of a run. A run which was not finished is interrupted.
+func restoreRun(path string) (*Run, error) {
+	stdout, err := stream.OpenBucket(path)
+	if err != nil {
+		return nil, err
+	}
+	var meta runMetadata
+	ok, err := stdout.Metadata(&meta)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+	stderr, err := stream.OpenBucket(meta.Stderr)
+	if err != nil {
+		return nil, err
+	}
+	outcome := _command.Outcome(meta.Outcome)
+	if outcome == "" {
+		outcome = _command.Interrupted
+		meta.ExitCode = -1
+		if meta.Ended.IsZero() {
+			meta.Ended = time.Now()
+		}
+	}
+	run := &Run{
+		Bucket: stdout,
+		Stderr: stderr,
+		Job: _command.RestoreJob(meta.Command, meta.Arguments,
+			meta.Started, meta.Ended, meta.ExitCode, outcome),
+		ContentType: meta.ContentType,
+		Slug:        meta.Slug,
+		key:         runKey(meta.Arguments),
+		ttl:         meta.TTL,
+		created:     meta.Created,
+	}
+	run.ctx, run.Cancel = context.WithCancel(context.TODO())
+	run.read()
+	if outcome == _command.Interrupted {
+		err = run.save()
+		if err != nil {
+			return nil, err
+		}
+	}
+	return run, nil
+}
+
+// Restore the runs saved in the storage folder, by a previous server.
+// Runs of unknown commands are only available by their ID.
+func (s *Server) Restore() (int, error) {
+	s.lock.RLock()
+	storage := s.storage
+	s.lock.RUnlock()
+	if storage == "" {
+		return 0, fmt.Errorf("No storage folder")
+	}
+	paths, err := filepath.Glob(filepath.Join(storage, "lb-*"))
+	if err != nil {
+		return 0, err
+	}
+	runs := make([]*Run, 0)
+	for _, path := range paths {
+		if _, err := os.Stat(filepath.Join(path, stream.ManifestName)); err != nil {
+			continue
+		}
+		run, err := restoreRun(path)
+		if err != nil {
+			fmt.Println("error", path, err)
+			continue
+		}
+		if run != nil {
+			runs = append(runs, run)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].created.Before(runs[j].created)
+	})
+	for _, run := range runs {
+		s.runs.add(run)
+		s.lock.RLock()
+		h, ok := s.handlers[run.Slug]
+		s.lock.RUnlock()
+		if ok {
+			h.restore(run)
+		}
+	}
+	return len(runs), nil
+}
@@ -0,0 +1,477 @@
+package api
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	_command "github.com/factorysh/stream_my_command/command"
+	"github.com/factorysh/stream_my_command/rfc7233"
+	"github.com/factorysh/stream_my_command/stream"
+	"github.com/google/uuid"
+	"github.com/gorilla/websocket"
+)
+
+// Run is a command run, with its STDOUT and STDERR buckets
+type Run struct {
+	Bucket      *stream.Bucket
+	Stderr      *stream.Bucket
+	Cancel      context.CancelFunc
+	Job         *_command.Job
+	ContentType string
+	Slug        string
+	key         string
+	ttl         time.Duration
+	created     time.Time
+	webhook     *webhook
+	ctx         context.Context
+	readers     int32
+	lastRead    int64
+	// dropped is 1 when the run waits for its last reader, 2 when removed
+	dropped int32
+	index   *runs
+	// done is closed when the run is finished and saved, nil if restored
+	done chan interface{}
+}
+
+// outcomeHeaders are sent as trailers when following a running command
+var outcomeHeaders = []string{
+	"Stream-Exit-Code",
+	"Stream-Duration",
+	"Stream-Outcome",
+	"Stream-Sha256",
+}
+
+// setOutcome sets the outcome headers of a finished run
+func (r *Run) setOutcome(header http.Header, bucket *stream.Bucket) {
+	header.Set("Stream-Exit-Code", strconv.Itoa(r.Job.ExitCode()))
+	header.Set("Stream-Duration", fmt.Sprintf("%.3f", r.Job.Duration().Seconds()))
+	header.Set("Stream-Outcome", string(r.Job.Outcome()))
+	header.Set("Stream-Sha256", hex.EncodeToString(bucket.Hash()))
+}
+
+// Chunk sizes of the buckets, STDERR is usually tiny
+const (
+	stdoutChunkSize = 10 * 1024 * 1024
+	stderrChunkSize = 64 * 1024
+)
+
+// runKey is the key of the arguments of a run
+func runKey(args []string) string {
+	return strings.Join(args, "/")
+}
+
+// newRun returns a new run, its buckets are in the storage folder,
+// or in the temp folder
+func newRun(c Command, args []string, storage string) (*Run, error) {
+	if storage == "" {
+		storage = os.TempDir()
+	}
+	stdout, err := stream.NewBucket(storage, stdoutChunkSize)
+	if err != nil {
+		return nil, err
+	}
+	stderr, err := stream.NewBucket(storage, stderrChunkSize)
+	if err != nil {
+		if err := stdout.Remove(); err != nil {
+			fmt.Println("error", err)
+		}
+		return nil, err
+	}
+	run := &Run{
+		Bucket:      stdout,
+		Stderr:      stderr,
+		Job:         _command.NewJob(stdout, c.Environment, c.Command, args...),
+		ContentType: c.ContentType,
+		Slug:        c.Slug,
+		key:         runKey(args),
+		ttl:         c.TTL,
+		created:     time.Now(),
+		done:        make(chan interface{}),
+	}
+	run.ctx, run.Cancel = context.WithCancel(context.TODO())
+	run.read()
+	run.Job.Stderr = stderr
+	run.Job.MaxDuration = c.MaxDuration
+	run.Job.GracePeriod = c.GracePeriod
+	err = run.save()
+	if err != nil {
+		if err := run.Remove(); err != nil {
+			fmt.Println("error", err)
+		}
+		return nil, err
+	}
+	return run, nil
+}
+
+// State of the run : queued, running or finished
+func (r *Run) State() _command.State {
+	return r.Job.State()
+}
+
+// setQueueHeaders sets the headers of a queued run
+func (r *Run) setQueueHeaders(w http.ResponseWriter) bool {
+	if r.State() != _command.Queued {
+		return false
+	}
+	w.Header().Set("Stream-Status", "queued")
+	w.Header().Set("Queue-Position", strconv.Itoa(r.Job.Position()))
+	return true
+}
+
+// ID of the run, the ID of its STDOUT bucket
+func (r *Run) ID() uuid.UUID {
+	return r.Bucket.ID()
+}
+
+// Expired says if the run is finished since more than the TTL of its command.
+// Without TTL, a run never expires.
+func (r *Run) Expired(now time.Time) bool {
+	if r.ttl <= 0 || r.State() != _command.Finished {
+		return false
+	}
+	return now.Sub(r.Job.Ended()) > r.ttl
+}
+
+// Remove the buckets of the run
+func (r *Run) Remove() error {
+	err := r.Bucket.Remove()
+	if err != nil {
+		return err
+	}
+	return r.Stderr.Remove()
+}
+
+// serve an output of the run, STDOUT or "stderr", or a range of it.
+// The length of a running output is unknown, only its tail can't be asked.
+func (r *Run) serve(w http.ResponseWriter, req *http.Request, output string, ranges *rfc7233.Ranges) {
+	bucket := r.Bucket
+	contentType := r.ContentType
+	if output == "stderr" {
+		bucket = r.Stderr
+		contentType = "text/plain"
+	}
+	if wantsEvents(req) {
+		r.serveEvents(w, req, bucket)
+		return
+	}
+	if wantsLines(req) {
+		r.serveLines(w, bucket)
+		return
+	}
+	following := !bucket.Closed()
+	length := -1
+	tag := ""
+	if !following {
+		length = bucket.Len()
+		tag = etag(bucket)
+	}
+	if status := checkConditions(req, tag); status != 0 {
+		if tag != "" {
+			w.Header().Set("ETag", tag)
+		}
+		w.Header().Set("X-Id", r.ID().String())
+		w.WriteHeader(status)
+		return
+	}
+	if !rangeApplies(req, tag) {
+		ranges = nil
+	}
+	interval := rfc7233.Interval{Start: 0, End: length}
+	partial := false
+	if ranges != nil {
+		intervals, err := ranges.Resolve(length)
+		if err != nil {
+			if !following {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", length))
+			}
+			w.Header().Set("X-Id", r.ID().String())
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+			return
+		}
+		if !following {
+			intervals = rfc7233.Coalesce(intervals)
+			if len(intervals) > 1 {
+				r.serveMultipart(w, req, bucket, contentType, intervals)
+				return
+			}
+		}
+		// multiple ranges of a running output are answered with the whole output
+		if len(intervals) == 1 {
+			interval = intervals[0]
+			partial = true
+		}
+	}
+	if !following {
+		r.setOutcome(w.Header(), bucket)
+		w.Header().Set("Content-Length", fmt.Sprintf("%d", interval.Len()))
+		w.Header().Set("ETag", tag)
+		if partial {
+			w.Header().Add("Content-Range",
+				fmt.Sprintf("bytes %d-%d/%d",
+					interval.Start,
+					interval.End-1,
+					length))
+		}
+	} else {
+		// a bounded range of a running output ends before the run
+		if req.Method != "HEAD" && interval.End < 0 {
+			w.Header().Set("Trailer", strings.Join(outcomeHeaders, ", "))
+		}
+		// an open range of a running output has no valid Content-Range
+		if partial && interval.End >= 0 {
+			w.Header().Add("Content-Range",
+				fmt.Sprintf("bytes %d-%d/*", interval.Start, interval.End-1))
+		}
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("X-Id", r.ID().String())
+	w.Header().Set("Stream-State", r.State().String())
+	if partial {
+		w.WriteHeader(http.StatusPartialContent)
+	}
+	if req.Method == "HEAD" {
+		return
+	}
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+	err := r.Copy(bucket, interval.Start, interval.End, w)
+	if err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	if following && interval.End < 0 {
+		r.setOutcome(w.Header(), bucket)
+	}
+}
+
+// serveMultipart answers multiple ranges of a finished output
+func (r *Run) serveMultipart(w http.ResponseWriter, req *http.Request, bucket *stream.Bucket, contentType string, intervals []rfc7233.Interval) {
+	mw := rfc7233.NewMultipartWriter(w, contentType, bucket.Len())
+	r.setOutcome(w.Header(), bucket)
+	w.Header().Set("ETag", etag(bucket))
+	w.Header().Set("Content-Type", mw.ContentType())
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("X-Id", r.ID().String())
+	w.Header().Set("Stream-State", r.State().String())
+	w.WriteHeader(http.StatusPartialContent)
+	if req.Method == "HEAD" {
+		return
+	}
+	for _, interval := range intervals {
+		part, err := mw.CreatePart(interval)
+		if err != nil {
+			fmt.Println("error", err)
+			return
+		}
+		err = r.Copy(bucket, interval.Start, interval.End, part)
+		if err != nil {
+			fmt.Println("error", err)
+			return
+		}
+	}
+	err := mw.Close()
+	if err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+// handle a request for an existing run : its output, its stderr, or its status
+func (r *Run) handle(w http.ResponseWriter, req *http.Request, output string) {
+	if output == "" && wantsStatus(req, r.ContentType) {
+		output = "status"
+	}
+	switch output {
+	case "status":
+		if req.Method != "GET" && req.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		r.writeStatus(w)
+	case "", "stderr":
+		if req.Method == "DELETE" && output == "" {
+			r.delete(w)
+			return
+		}
+		if req.Method != "GET" && req.Method != "HEAD" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		ranges, err := parseRanges(req)
+		if err != nil {
+			w.WriteHeader(400)
+			return
+		}
+		if !r.setQueueHeaders(w) {
+			w.Header().Set("Stream-Status", "refurbished")
+		}
+		r.serve(w, req, output, ranges)
+	case "ws":
+		if !websocket.IsWebSocketUpgrade(req) {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		r.serveWebSocket(w, req)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+	}
+}
+
+// Accepted is the answer of an async run
+type Accepted struct {
+	ID       string `json:"id"`
+	Location string `json:"location"`
+	Status   string `json:"status"`
+}
+
+// accept answers an async run, without streaming. The client attaches later
+// with the URL of the run.
+func (r *Run) accept(w http.ResponseWriter) {
+	location := "/api/v1/runs/" + r.ID().String()
+	w.Header().Set("Location", location)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Id", r.ID().String())
+	w.WriteHeader(http.StatusAccepted)
+	err := json.NewEncoder(w).Encode(&Accepted{
+		ID:       r.ID().String(),
+		Location: location,
+		Status:   location + "/status",
+	})
+	if err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+// delete cancels the run
+func (r *Run) delete(w http.ResponseWriter) {
+	r.Cancel()
+	w.Header().Set("X-Id", r.ID().String())
+	w.WriteHeader(200)
+}
+
+// Copy a bucket of the run to a reader, from start to end (excluded),
+// a negative end copies until the end of the run
+func (r *Run) Copy(bucket *stream.Bucket, start, end int, w io.Writer) error {
+	atomic.AddInt32(&r.readers, 1)
+	defer r.release()
+	r.read()
+	defer r.read()
+	return bucket.CopyRange(start, end, w)
+}
+
+// drop removes the run from the index, and its buckets, as soon as it
+// has no more readers
+func (r *Run) drop(index *runs) {
+	r.index = index
+	atomic.StoreInt32(&r.dropped, 1)
+	r.dispose()
+}
+
+// release a reader, the last reader of a dropped run removes it
+func (r *Run) release() {
+	atomic.AddInt32(&r.readers, -1)
+	r.dispose()
+}
+
+// dispose of a dropped run without readers, only once
+func (r *Run) dispose() {
+	if atomic.LoadInt32(&r.readers) > 0 ||
+		!atomic.CompareAndSwapInt32(&r.dropped, 1, 2) {
+		return
+	}
+	if r.index != nil {
+		r.index.remove(r.ID())
+	}
+	err := r.Remove()
+	if err != nil {
+		fmt.Println("error", err)
+	}
+}
+
+func (r *Run) read() {
+	atomic.StoreInt64(&r.lastRead, time.Now().UnixNano())
+}
+
+// LastRead is the last time a reader was attached
+func (r *Run) LastRead() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&r.lastRead))
+}
+
+// Size of the buckets of the run, with their logs of write times
+func (r *Run) Size() int {
+	return r.Bucket.Len() + r.Bucket.StampsLen() + r.Stderr.Len() + r.Stderr.StampsLen()
+}
+
+// Readers is the number of attached readers
+func (r *Run) Readers() int {
+	return int(atomic.LoadInt32(&r.readers))
+}
+
+// Status of a run
+type Status struct {
+	ID            string           `json:"id"`
+	Argv          []string         `json:"argv"`
+	State         string           `json:"state"`
+	QueuePosition int              `json:"queue_position,omitempty"`
+	Outcome       string           `json:"outcome,omitempty"`
+	Start         *time.Time       `json:"start,omitempty"`
+	End           *time.Time       `json:"end,omitempty"`
+	ExitCode      *int             `json:"exit_code,omitempty"`
+	Length        int              `json:"length"`
+	Sha256        string           `json:"sha256"`
+	Readers       int              `json:"readers"`
+	Path          string           `json:"path"`
+	StderrLength  int              `json:"stderr_length"`
+	StderrPath    string           `json:"stderr_path"`
+	Webhook       *WebhookDelivery `json:"webhook,omitempty"`
+}
+
+// Status of the run, running or finished
+func (r *Run) Status() *Status {
+	status := &Status{
+		ID:            r.ID().String(),
+		Argv:          append([]string{r.Job.Name}, r.Job.Args...),
+		State:         r.State().String(),
+		QueuePosition: r.Job.Position(),
+		Outcome:       string(r.Job.Outcome()),
+		Length:        r.Bucket.Len(),
+		Sha256:        hex.EncodeToString(r.Bucket.Hash()),
+		Readers:       r.Readers(),
+		Path:          r.Bucket.Path(),
+		StderrLength:  r.Stderr.Len(),
+		StderrPath:    r.Stderr.Path(),
+	}
+	start := r.Job.Started()
+	if !start.IsZero() {
+		status.Start = &start
+	}
+	end := r.Job.Ended()
+	if !end.IsZero() {
+		status.End = &end
+		code := r.Job.ExitCode()
+		status.ExitCode = &code
+	}
+	if r.webhook != nil {
+		status.Webhook = r.webhook.Delivery()
+	}
+	return status
+}
+
+func (r *Run) writeStatus(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Id", r.ID().String())
+	err := json.NewEncoder(w).Encode(r.Status())
+	if err != nil {
+		fmt.Println("error", err)
+	}
+}
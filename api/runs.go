@@ -0,0 +1,71 @@
+package api
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// runs indexes runs by their ID
+type runs struct {
+	lock *sync.RWMutex
+	runs map[uuid.UUID]*Run
+}
+
+func newRuns() *runs {
+	return &runs{
+		lock: &sync.RWMutex{},
+		runs: make(map[uuid.UUID]*Run),
+	}
+}
+
+func (r *runs) add(run *Run) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	r.runs[run.ID()] = run
+}
+
+func (r *runs) remove(id uuid.UUID) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.runs, id)
+}
+
+func (r *runs) list() []*Run {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	l := make([]*Run, 0, len(r.runs))
+	for _, run := range r.runs {
+		l = append(l, run)
+	}
+	return l
+}
+
+func (r *runs) get(id uuid.UUID) (*Run, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+	run, ok := r.runs[id]
+	return run, ok
+}
+
+// ServeHTTP serves /api/v1/runs/{uuid}, with its stderr and status
+func (r *runs) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	slugs := strings.Split(req.URL.Path, "/")
+	if len(slugs) < 5 {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	id, err := uuid.Parse(slugs[4])
+	if err != nil {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	run, ok := r.get(id)
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	run.handle(w, req, strings.Join(slugs[5:], "/"))
+}
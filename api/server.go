@@ -0,0 +1,179 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	_command "github.com/factorysh/stream_my_command/command"
+)
+
+// Server exposes commands under /api/v1/{slug}/, commands can be reloaded.
+// Runs are available by their ID under /api/v1/runs/{uuid}.
+// All commands share a Pool, each command can have its own limit too.
+type Server struct {
+	lock     *sync.RWMutex
+	handlers map[string]*handler
+	pool     *_command.Pool
+	runs     *runs
+	quota    int
+	storage  string
+}
+
+// NewServer returns an empty Server, without concurrency limit
+func NewServer() *Server {
+	return &Server{
+		lock:     &sync.RWMutex{},
+		handlers: make(map[string]*handler),
+		pool:     _command.NewPool(0),
+		runs:     newRuns(),
+	}
+}
+
+// Register a command, replacing the one with the same slug
+func (s *Server) Register(command Command) error {
+	err := command.Validate()
+	if err != nil {
+		return err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.register(command)
+}
+
+func (s *Server) register(command Command) error {
+	h, ok := s.handlers[command.Slug]
+	if ok {
+		err := h.update(command)
+		if err != nil {
+			return err
+		}
+		h.setStorage(s.storage)
+		return nil
+	}
+	h, err := newHandler(command, s.pool, s.runs)
+	if err != nil {
+		return err
+	}
+	h.finished = s.runFinished
+	h.setStorage(s.storage)
+	s.handlers[command.Slug] = h
+	return nil
+}
+
+// Load the commands of a config. New commands are added, modified commands
+// are updated, removed commands don't accept new runs. Running commands
+// are not touched.
+func (s *Server) Load(cfg *Config) error {
+	err := cfg.Validate()
+	if err != nil {
+		return err
+	}
+	if cfg.Storage != "" {
+		err = os.MkdirAll(cfg.Storage, 0700)
+		if err != nil {
+			return err
+		}
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.pool.SetSize(cfg.Concurrency)
+	s.quota = cfg.Quota
+	s.storage = cfg.Storage
+	slugs := make(map[string]interface{})
+	for _, command := range cfg.Commands {
+		err = s.register(command)
+		if err != nil {
+			return err
+		}
+		slugs[command.Slug] = new(interface{})
+	}
+	for slug, h := range s.handlers {
+		if _, ok := slugs[slug]; !ok {
+			h.remove()
+		}
+	}
+	return nil
+}
+
+// Expire forgets the runs finished since more than their TTL, and removes
+// their buckets. Runs with attached readers wait for the next time.
+func (s *Server) Expire() {
+	now := time.Now()
+	for _, run := range s.runs.list() {
+		if !run.Expired(now) || run.Readers() > 0 {
+			continue
+		}
+		s.drop(run)
+	}
+}
+
+// drop forgets a run, and removes its buckets
+func (s *Server) drop(run *Run) {
+	s.lock.RLock()
+	h, ok := s.handlers[run.Slug]
+	s.lock.RUnlock()
+	if ok {
+		h.forget(run)
+	}
+	run.drop(s.runs)
+}
+
+// Stop cancels the runs, their process groups are killed, and waits until
+// their outcomes are saved. New runs are refused, as for removed commands.
+func (s *Server) Stop() {
+	s.lock.RLock()
+	for _, h := range s.handlers {
+		h.remove()
+	}
+	s.lock.RUnlock()
+	for _, run := range s.runs.list() {
+		if run.done == nil {
+			continue
+		}
+		run.Cancel()
+		<-run.done
+	}
+}
+
+// Janitor expires and evicts runs at each interval, until the context is done
+func (s *Server) Janitor(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			s.Expire()
+			s.Evict()
+		}
+	}
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	slugs := strings.Split(r.URL.Path, "/")
+	if len(slugs) < 4 || slugs[1] != "api" || slugs[2] != "v1" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if slugs[3] == "runs" {
+		s.runs.ServeHTTP(w, r)
+		return
+	}
+	if slugs[3] == "admin" {
+		s.serveAdmin(w, r, strings.Join(slugs[4:], "/"))
+		return
+	}
+	s.lock.RLock()
+	h, ok := s.handlers[slugs[3]]
+	s.lock.RUnlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	h.ServeHTTP(w, r)
+}
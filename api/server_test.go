@@ -0,0 +1,115 @@
+package api
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func post(t *testing.T, url string) (*http.Response, string) {
+	r, err := http.Post(url, "", nil)
+	assert.NoError(t, err)
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	assert.NoError(t, err)
+	return r, string(body)
+}
+
+func get(t *testing.T, url string) (*http.Response, string) {
+	r, err := http.Get(url)
+	assert.NoError(t, err)
+	defer r.Body.Close()
+	body, err := ioutil.ReadAll(r.Body)
+	assert.NoError(t, err)
+	return r, string(body)
+}
+
+func TestReload(t *testing.T) {
+	server := NewServer()
+	err := server.Load(&Config{Commands: []Command{
+		{
+			Slug:      "slow",
+			Command:   "sh",
+			Arguments: []string{"-c", "echo $0; sleep 0.3; echo end", "$1"},
+		},
+	}})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	done := make(chan string)
+	go func() {
+		_, body := get(t, ts.URL+"/api/v1/slow/start")
+		done <- body
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	err = server.Load(&Config{Commands: []Command{
+		{
+			Slug:      "echo",
+			Command:   "echo",
+			Arguments: []string{"$1"},
+		},
+	}})
+	assert.NoError(t, err)
+
+	r, body := get(t, ts.URL+"/api/v1/echo/hello")
+	assert.Equal(t, 200, r.StatusCode)
+	assert.Equal(t, "hello\n", body)
+
+	r, _ = get(t, ts.URL+"/api/v1/slow/other")
+	assert.Equal(t, http.StatusNotFound, r.StatusCode)
+
+	assert.Equal(t, "start\nend\n", <-done)
+
+	r, body = get(t, ts.URL+"/api/v1/slow/start")
+	assert.Equal(t, 200, r.StatusCode)
+	assert.Equal(t, "refurbished", r.Header.Get("Stream-Status"))
+	assert.Equal(t, "start\nend\n", body)
+}
+
+func TestBadReload(t *testing.T) {
+	server := NewServer()
+	err := server.Register(Command{
+		Slug:      "echo",
+		Command:   "echo",
+		Arguments: []string{"$1"},
+	})
+	assert.NoError(t, err)
+	err = server.Load(&Config{Commands: []Command{{Slug: "echo"}}})
+	assert.Error(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+	r, body := get(t, ts.URL+"/api/v1/echo/hello")
+	assert.Equal(t, 200, r.StatusCode)
+	assert.Equal(t, "hello\n", body)
+}
+
+func TestStop(t *testing.T) {
+	server := NewServer()
+	err := server.Register(Command{
+		Slug:      "sleep",
+		Command:   "sh",
+		Arguments: []string{"-c", "sleep $0 & wait", "$1"},
+	})
+	assert.NoError(t, err)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	r, _ := post(t, ts.URL+"/api/v1/sleep/60?async=1")
+	assert.Equal(t, http.StatusAccepted, r.StatusCode)
+	runs := server.runs.list()
+	assert.Equal(t, 1, len(runs))
+
+	start := time.Now()
+	server.Stop()
+	assert.True(t, time.Since(start) < 10*time.Second)
+	assert.Equal(t, "cancelled", string(runs[0].Job.Outcome()))
+
+	r, _ = get(t, ts.URL+"/api/v1/sleep/1")
+	assert.Equal(t, http.StatusNotFound, r.StatusCode)
+}
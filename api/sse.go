@@ -0,0 +1,169 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/factorysh/stream_my_command/stream"
+)
+
+// sseHeartbeat is the interval between two comments, which keep the connection alive
+var sseHeartbeat = 15 * time.Second
+
+// wantsEvents says if the client asks for Server-Sent Events
+func wantsEvents(r *http.Request) bool {
+	return r.Method == "GET" &&
+		strings.Contains(r.Header.Get("Accept"), "text/event-stream")
+}
+
+// eventWriter frames an output as Server-Sent Events, one event per line.
+// The id of an event is the offset of the end of its line.
+type eventWriter struct {
+	lock   *sync.Mutex
+	ctx    context.Context
+	w      io.Writer
+	lines  *lineSplitter
+	closed bool
+}
+
+func newEventWriter(ctx context.Context, w io.Writer, offset int) *eventWriter {
+	return &eventWriter{
+		lock:  &sync.Mutex{},
+		ctx:   ctx,
+		w:     w,
+		lines: &lineSplitter{offset: offset},
+	}
+}
+
+func (e *eventWriter) flush() {
+	if f, ok := e.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// event writes a data event, the lock must be held. A carriage return
+// ends a data line too, as in progress bars : each segment is its own data line.
+func (e *eventWriter) event(line []byte, start, end int) error {
+	line = bytes.TrimSuffix(line, []byte("\r"))
+	_, err := fmt.Fprintf(e.w, "id: %d\n", end)
+	if err != nil {
+		return err
+	}
+	for _, segment := range bytes.Split(line, []byte("\r")) {
+		_, err = fmt.Fprintf(e.w, "data: %s\n", segment)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(e.w, "\n")
+	return err
+}
+
+func (e *eventWriter) Write(p []byte) (int, error) {
+	if err := e.ctx.Err(); err != nil {
+		return 0, err
+	}
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	err := e.lines.split(p, e.event)
+	if err != nil {
+		return 0, err
+	}
+	e.flush()
+	return len(p), nil
+}
+
+// heartbeat writes a comment at each interval, until the context is done
+func (e *eventWriter) heartbeat(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			e.lock.Lock()
+			if e.closed {
+				e.lock.Unlock()
+				return
+			}
+			_, err := io.WriteString(e.w, ": heartbeat\n\n")
+			if err == nil {
+				e.flush()
+			}
+			e.lock.Unlock()
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// close writes the last line without its line feed, and the exit event
+func (e *eventWriter) close(status *Status) error {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	e.closed = true
+	err := e.lines.rest(e.event)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(e.w, "event: exit\ndata: %s\n\n", data)
+	e.flush()
+	return err
+}
+
+// serveEvents streams an output as Server-Sent Events. Last-Event-ID
+// resumes the stream after the last received line.
+func (r *Run) serveEvents(w http.ResponseWriter, req *http.Request, bucket *stream.Bucket) {
+	start := 0
+	if last := req.Header.Get("Last-Event-ID"); last != "" {
+		var err error
+		start, err = strconv.Atoi(last)
+		if err != nil || start < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if bucket.Closed() && start > bucket.Len() {
+			start = bucket.Len()
+		}
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Id", r.ID().String())
+	w.WriteHeader(http.StatusOK)
+	events := newEventWriter(req.Context(), w, start)
+	events.flush()
+	ctx, cancel := context.WithCancel(req.Context())
+	done := make(chan interface{})
+	go func() {
+		events.heartbeat(ctx, sseHeartbeat)
+		close(done)
+	}()
+	// the heartbeat must not write after the end of the handler
+	defer func() {
+		cancel()
+		<-done
+	}()
+	err := r.Copy(bucket, start, -1, events)
+	if err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	err = events.close(r.Status())
+	if err != nil {
+		fmt.Println("error", err)
+	}
+}
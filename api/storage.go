@@ -0,0 +1,93 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+
+	_command "github.com/factorysh/stream_my_command/command"
+)
+
+// Storage is the disk usage of all the runs
+type Storage struct {
+	Quota   int `json:"quota"`
+	Usage   int `json:"usage"`
+	Runs    int `json:"runs"`
+	Running int `json:"running"`
+}
+
+// Storage returns the disk usage of all the runs
+func (s *Server) Storage() *Storage {
+	s.lock.RLock()
+	storage := &Storage{
+		Quota: s.quota,
+	}
+	s.lock.RUnlock()
+	for _, run := range s.runs.list() {
+		storage.Usage += run.Size()
+		storage.Runs++
+		if run.State() != _command.Finished {
+			storage.Running++
+		}
+	}
+	return storage
+}
+
+// SetQuota sets the maximum size of all the runs, 0 is unlimited
+func (s *Server) SetQuota(quota int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.quota = quota
+}
+
+// Evict removes the least recently read finished runs, until the usage
+// is under the quota. Running runs, and runs with readers are never evicted.
+func (s *Server) Evict() {
+	s.lock.RLock()
+	quota := s.quota
+	s.lock.RUnlock()
+	if quota <= 0 {
+		return
+	}
+	usage := 0
+	candidates := make([]*Run, 0)
+	for _, run := range s.runs.list() {
+		usage += run.Size()
+		if run.State() == _command.Finished && run.Readers() == 0 {
+			candidates = append(candidates, run)
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		return candidates[i].LastRead().Before(candidates[j].LastRead())
+	})
+	for _, run := range candidates {
+		if usage <= quota {
+			return
+		}
+		usage -= run.Size()
+		fmt.Println("evict", run.ID())
+		s.drop(run)
+	}
+}
+
+func (s *Server) runFinished(run *Run) {
+	s.Evict()
+}
+
+// serveAdmin serves /api/v1/admin/
+func (s *Server) serveAdmin(w http.ResponseWriter, r *http.Request, path string) {
+	if path != "storage" {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	if r.Method != "GET" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	err := json.NewEncoder(w).Encode(s.Storage())
+	if err != nil {
+		fmt.Println("error", err)
+	}
+}
@@ -0,0 +1,145 @@
+package api
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// webhookAttempts is the number of deliveries before giving up
+	webhookAttempts = 5
+	// webhookBackoff is the wait before the first retry, doubled each time
+	webhookBackoff = time.Second
+	webhookClient  = &http.Client{Timeout: 10 * time.Second}
+)
+
+// WebhookPayload is POSTed to the webhook when a run ends
+type WebhookPayload struct {
+	ID       string   `json:"id"`
+	Argv     []string `json:"argv"`
+	Outcome  string   `json:"outcome"`
+	ExitCode int      `json:"exit_code"`
+	Duration float64  `json:"duration"`
+	Length   int      `json:"length"`
+	Sha256   string   `json:"sha256"`
+}
+
+// WebhookDelivery is the state of the webhook of a run
+type WebhookDelivery struct {
+	URL         string     `json:"url"`
+	Attempts    int        `json:"attempts"`
+	Delivered   bool       `json:"delivered"`
+	StatusCode  int        `json:"status_code,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	LastAttempt *time.Time `json:"last_attempt,omitempty"`
+}
+
+// webhook of a run, with its deliveries
+type webhook struct {
+	lock     *sync.Mutex
+	delivery WebhookDelivery
+}
+
+func newWebhook(u string) *webhook {
+	return &webhook{
+		lock:     &sync.Mutex{},
+		delivery: WebhookDelivery{URL: u},
+	}
+}
+
+// validateWebhook accepts only absolute http(s) URLs
+func validateWebhook(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("Bad webhook URL : %s", raw)
+	}
+	return nil
+}
+
+// allowsWebhook says if the host of a webhook named by a request is in the
+// allowed hosts of the command. Without allowed hosts, requests can't name webhooks.
+func (c *Command) allowsWebhook(raw string) bool {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return false
+	}
+	for _, host := range c.WebhookHosts {
+		if strings.EqualFold(u.Hostname(), host) {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivery is a copy of the delivery state
+func (w *webhook) Delivery() *WebhookDelivery {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	d := w.delivery
+	return &d
+}
+
+// attempt POSTs the payload once
+func (w *webhook) attempt(body []byte) bool {
+	resp, err := webhookClient.Post(w.delivery.URL, "application/json", bytes.NewReader(body))
+	now := time.Now()
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.delivery.Attempts++
+	w.delivery.LastAttempt = &now
+	if err != nil {
+		w.delivery.Error = err.Error()
+		w.delivery.StatusCode = 0
+		return false
+	}
+	resp.Body.Close()
+	w.delivery.StatusCode = resp.StatusCode
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		w.delivery.Error = resp.Status
+		return false
+	}
+	w.delivery.Error = ""
+	w.delivery.Delivered = true
+	return true
+}
+
+// notify POSTs the summary of a finished run to its webhook, with retries
+func (r *Run) notify() {
+	if r.webhook == nil {
+		return
+	}
+	body, err := json.Marshal(&WebhookPayload{
+		ID:       r.ID().String(),
+		Argv:     append([]string{r.Job.Name}, r.Job.Args...),
+		Outcome:  string(r.Job.Outcome()),
+		ExitCode: r.Job.ExitCode(),
+		Duration: r.Job.Duration().Seconds(),
+		Length:   r.Bucket.Len(),
+		Sha256:   hex.EncodeToString(r.Bucket.Hash()),
+	})
+	if err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	backoff := webhookBackoff
+	for i := 0; i < webhookAttempts; i++ {
+		if i > 0 {
+			time.Sleep(backoff)
+			backoff *= 2
+		}
+		if r.webhook.attempt(body) {
+			return
+		}
+	}
+	fmt.Println("error", "webhook", r.webhook.delivery.URL, "failed")
+}
@@ -0,0 +1,185 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/gorilla/websocket"
+)
+
+var upgrader = websocket.Upgrader{}
+
+// signals which can be sent by a client
+var signals = map[string]syscall.Signal{
+	"HUP":  syscall.SIGHUP,
+	"INT":  syscall.SIGINT,
+	"QUIT": syscall.SIGQUIT,
+	"TERM": syscall.SIGTERM,
+	"KILL": syscall.SIGKILL,
+	"USR1": syscall.SIGUSR1,
+	"USR2": syscall.SIGUSR2,
+	"STOP": syscall.SIGSTOP,
+	"CONT": syscall.SIGCONT,
+}
+
+// Control is a message from the client : cancel, signal, pause or resume
+type Control struct {
+	Action string `json:"action"`
+	Signal string `json:"signal,omitempty"`
+}
+
+// Event is a message to the client : ack, error or exit
+type Event struct {
+	Event  string  `json:"event"`
+	Action string  `json:"action,omitempty"`
+	Error  string  `json:"error,omitempty"`
+	Status *Status `json:"status,omitempty"`
+}
+
+// wsStream sends an output as binary messages, and can be paused
+type wsStream struct {
+	conn   *websocket.Conn
+	lock   *sync.Mutex
+	cond   *sync.Cond
+	paused bool
+	closed bool
+}
+
+func newWsStream(conn *websocket.Conn) *wsStream {
+	return &wsStream{
+		conn: conn,
+		lock: &sync.Mutex{},
+		cond: sync.NewCond(&sync.Mutex{}),
+	}
+}
+
+func (s *wsStream) Write(p []byte) (int, error) {
+	s.cond.L.Lock()
+	for s.paused && !s.closed {
+		s.cond.Wait()
+	}
+	closed := s.closed
+	s.cond.L.Unlock()
+	if closed {
+		return 0, websocket.ErrCloseSent
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err := s.conn.WriteMessage(websocket.BinaryMessage, p)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// send an event, as a JSON text message
+func (s *wsStream) send(event *Event) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.conn.WriteJSON(event)
+}
+
+func (s *wsStream) pause(paused bool) {
+	s.cond.L.Lock()
+	s.paused = paused
+	s.cond.L.Unlock()
+	s.cond.Broadcast()
+}
+
+func (s *wsStream) close() {
+	s.cond.L.Lock()
+	s.closed = true
+	s.cond.L.Unlock()
+	s.cond.Broadcast()
+}
+
+// control reads the messages of the client, until the connection is closed
+func (s *wsStream) control(r *Run) {
+	defer s.close()
+	for {
+		_, message, err := s.conn.ReadMessage()
+		if err != nil { // closed by the client, or by the end of the run
+			return
+		}
+		var control Control
+		err = json.Unmarshal(message, &control)
+		if err != nil {
+			if s.send(&Event{Event: "error", Error: err.Error()}) != nil {
+				return
+			}
+			continue
+		}
+		switch control.Action {
+		case "cancel":
+			r.Cancel()
+		case "signal":
+			sig, ok := signals[strings.TrimPrefix(strings.ToUpper(control.Signal), "SIG")]
+			if !ok {
+				err = fmt.Errorf("Unknown signal : %s", control.Signal)
+				break
+			}
+			err = r.Job.Signal(sig)
+		case "pause":
+			s.pause(true)
+		case "resume":
+			s.pause(false)
+		default:
+			err = fmt.Errorf("Unknown action : %s", control.Action)
+		}
+		event := &Event{Event: "ack", Action: control.Action}
+		if err != nil {
+			event = &Event{Event: "error", Action: control.Action, Error: err.Error()}
+		}
+		if s.send(event) != nil {
+			return
+		}
+	}
+}
+
+// serveWebSocket streams the STDOUT of the run from ?offset=, as binary
+// messages, and obeys the control messages of the client. The last message
+// is the exit event, with the status of the run.
+func (r *Run) serveWebSocket(w http.ResponseWriter, req *http.Request) {
+	offset := 0
+	if raw := req.URL.Query().Get("offset"); raw != "" {
+		var err error
+		offset, err = strconv.Atoi(raw)
+		if err != nil || offset < 0 {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if r.Bucket.Closed() && offset > r.Bucket.Len() {
+			offset = r.Bucket.Len()
+		}
+	}
+	conn, err := upgrader.Upgrade(w, req, http.Header{"X-Id": {r.ID().String()}})
+	if err != nil { // the upgrader has already answered
+		fmt.Println("error", err)
+		return
+	}
+	defer conn.Close()
+	s := newWsStream(conn)
+	go s.control(r)
+	err = r.Copy(r.Bucket, offset, -1, s)
+	if err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	err = s.send(&Event{Event: "exit", Status: r.Status()})
+	if err != nil {
+		fmt.Println("error", err)
+		return
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	err = conn.WriteMessage(websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	if err != nil {
+		fmt.Println("error", err)
+	}
+}
@@ -1,20 +1,69 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/factorysh/stream_my_command/api"
 )
 
 func main() {
-	mux := http.NewServeMux()
-	api.Register(mux, api.Command{
-		Slug:        "nmap",
-		Command:     "nmap",
-		Arguments:   []string{"-A", "-T4", "-oX", "-", "$1"},
-		ContentType: "application/xml",
-	})
-	http.Handle("/", mux)
-	log.Fatal(http.ListenAndServe(":5000", nil))
+	config := flag.String("config", "stream.yml", "YAML or JSON config file")
+	listen := flag.String("listen", ":5000", "Listen address")
+	janitor := flag.Duration("janitor", time.Minute, "Interval between expirations of old runs")
+	flag.Parse()
+
+	cfg, err := api.ReadConfig(*config)
+	if err != nil {
+		log.Fatal(err)
+	}
+	server := api.NewServer()
+	err = server.Load(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if cfg.Storage != "" {
+		n, err := server.Restore()
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Println("Runs restored :", n)
+	}
+
+	go server.Janitor(context.Background(), *janitor)
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			cfg, err := api.ReadConfig(*config)
+			if err == nil {
+				err = server.Load(cfg)
+			}
+			if err != nil {
+				log.Println("Reload error, keeping the current config :", err)
+				continue
+			}
+			log.Println("Config reloaded", *config)
+		}
+	}()
+
+	// the commands run in their own process groups, they are stopped with the server
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-stop
+		log.Println("Stopping the runs, on", sig)
+		server.Stop()
+		os.Exit(0)
+	}()
+
+	http.Handle("/", server)
+	log.Fatal(http.ListenAndServe(*listen, nil))
 }
@@ -32,6 +32,17 @@ func (a Arguments) Values(args ...string) ([]string, error) {
 	return zargs, nil
 }
 
+// Arity is the number of arguments needed by Values
+func (a Arguments) Arity() int {
+	n := 0
+	for _, arg := range a {
+		if v, ok := arg.(vararg); ok && int(v) > n {
+			n = int(v)
+		}
+	}
+	return n
+}
+
 type Valueable interface {
 	Value(args ...string) (string, error)
 }
@@ -12,4 +12,8 @@ func TestArguments(t *testing.T) {
 	v, err := a.Values("pam")
 	assert.NoError(t, err)
 	assert.Equal(t, []string{"pim", "pam", "poum"}, v)
+	assert.Equal(t, 1, a.Arity())
+	a, err = NewArguments("$2", "pim", "$1")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, a.Arity())
 }
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"container/list"
 	"context"
 	"fmt"
 	"io"
@@ -9,34 +10,195 @@ import (
 	"sync"
 )
 
+// Pool limits the number of running commands, extra commands are queued.
+// A Pool can have a parent, a command needs a slot in both of them.
 type Pool struct {
-	lock sync.RWMutex
+	lock    *sync.Mutex
+	size    int
+	running int
+	queue   *list.List
+	parent  *Pool
 }
 
-func NewPool() *Pool {
+// NewPool returns a Pool running at most size commands, 0 is unlimited
+func NewPool(size int) *Pool {
 	return &Pool{
-		lock: sync.RWMutex{},
+		lock:  &sync.Mutex{},
+		size:  size,
+		queue: list.New(),
 	}
 }
 
-func (p *Pool) Command(ctx context.Context, out io.WriteCloser, env map[string]string, name string, args ...string) error {
+// Child returns a Pool with its own limit, which uses the slots of this Pool
+func (p *Pool) Child(size int) *Pool {
+	c := NewPool(size)
+	c.parent = p
+	return c
+}
+
+// SetSize changes the limit, queued commands may start
+func (p *Pool) SetSize(size int) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.size = size
+	p.next()
+}
+
+// Running is the number of running commands
+func (p *Pool) Running() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.running
+}
+
+// Queued is the number of commands waiting for a slot
+func (p *Pool) Queued() int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	return p.queue.Len()
+}
+
+func (p *Pool) full() bool {
+	return p.size > 0 && p.running >= p.size
+}
+
+// next gives free slots to the first waiting commands
+func (p *Pool) next() {
+	for p.queue.Len() > 0 && !p.full() {
+		e := p.queue.Front()
+		p.queue.Remove(e)
+		p.running++
+		close(e.Value.(chan interface{}))
+	}
+}
+
+// position of a queued element, 1 is the next one, 0 is not queued
+func (p *Pool) position(elem *list.Element) int {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	i := 1
+	for e := p.queue.Front(); e != nil; e = e.Next() {
+		if e == elem {
+			return i
+		}
+		i++
+	}
+	return 0
+}
+
+func (p *Pool) acquireSlot(ctx context.Context, t *ticket) error {
+	p.lock.Lock()
+	if p.queue.Len() == 0 && !p.full() {
+		p.running++
+		p.lock.Unlock()
+		return nil
+	}
+	ready := make(chan interface{})
+	e := p.queue.PushBack(ready)
+	p.lock.Unlock()
+	t.queue(p, e)
+	defer t.dequeue()
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		p.lock.Lock()
+		defer p.lock.Unlock()
+		select {
+		case <-ready: // the slot was given meanwhile
+			p.running--
+			p.next()
+		default:
+			p.queue.Remove(e)
+		}
+		return ctx.Err()
+	}
+}
+
+func (p *Pool) releaseSlot() {
 	p.lock.Lock()
 	defer p.lock.Unlock()
-	defer out.Close()
-	cmd := exec.CommandContext(ctx, name, args...)
-	cmd.Stdout = out
-	cmd.Stderr = os.Stderr
+	p.running--
+	p.next()
+}
+
+// Acquire waits for a slot, in this Pool and its parents
+func (p *Pool) Acquire(ctx context.Context) error {
+	return p.acquire(ctx, newTicket())
+}
+
+func (p *Pool) acquire(ctx context.Context, t *ticket) error {
+	err := p.acquireSlot(ctx, t)
+	if err != nil {
+		return err
+	}
+	if p.parent != nil {
+		err = p.parent.acquire(ctx, t)
+		if err != nil {
+			p.releaseSlot()
+			return err
+		}
+	}
+	return nil
+}
+
+// Release a slot taken with Acquire
+func (p *Pool) Release() {
+	if p.parent != nil {
+		p.parent.Release()
+	}
+	p.releaseSlot()
+}
+
+// Command runs a command, when the Pool has a free slot
+func (p *Pool) Command(ctx context.Context, out io.WriteCloser, env map[string]string, name string, args ...string) error {
+	return p.Run(ctx, NewJob(out, env, name, args...))
+}
+
+// Run a Job, when the Pool has a free slot. A Job canceled while queued
+// is never started. The outcome of the Job is set before closing its outputs.
+func (p *Pool) Run(ctx context.Context, job *Job) error {
+	err := p.run(ctx, job)
+	job.finish(ctx, err)
+	job.Stdout.Close()
+	if job.Stderr != nil {
+		job.Stderr.Close()
+	}
+	return err
+}
+
+func (p *Pool) run(ctx context.Context, job *Job) error {
+	err := p.acquire(ctx, job.ticket)
+	if err != nil {
+		return err
+	}
+	defer p.Release()
+	job.setState(Running)
+	cmd := exec.Command(job.Name, job.Args...)
+	newProcessGroup(cmd)
+	cmd.Stdout = job.Stdout
+	if job.Stderr == nil {
+		cmd.Stderr = os.Stderr
+	} else {
+		cmd.Stderr = job.Stderr
+	}
 	envs := make([]string, 0)
-	if env != nil {
-		for k, v := range env {
+	if job.Env != nil {
+		for k, v := range job.Env {
 			// FIXME assert k ~=[a-zA-Z_][a-zA-Z_0-9]+
 			envs = append(envs, fmt.Sprintf("%s=%s", k, v))
 		}
 	}
 	cmd.Env = envs
-	err := cmd.Start()
+	err = cmd.Start()
 	if err != nil {
 		return err
 	}
-	return cmd.Wait()
+	job.start(cmd.Process)
+	done := make(chan interface{})
+	go job.watch(ctx, cmd.Process, done)
+	err = cmd.Wait()
+	close(done)
+	job.exit(cmd.ProcessState.ExitCode())
+	return err
 }
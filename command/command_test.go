@@ -0,0 +1,174 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type buffer struct {
+	*bytes.Buffer
+}
+
+func (b *buffer) Close() error {
+	return nil
+}
+
+func TestPool(t *testing.T) {
+	p := NewPool(2)
+	wg := &sync.WaitGroup{}
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			err := p.Command(context.TODO(), &buffer{bytes.NewBuffer(nil)}, nil, "sleep", "0.2")
+			assert.NoError(t, err)
+			wg.Done()
+		}()
+	}
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, 2, p.Running())
+	assert.Equal(t, 1, p.Queued())
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, 1, p.Running())
+	assert.Equal(t, 0, p.Queued())
+	wg.Wait()
+	assert.Equal(t, 0, p.Running())
+}
+
+func TestPoolCancelQueued(t *testing.T) {
+	p := NewPool(1)
+	err := p.Acquire(context.TODO())
+	assert.NoError(t, err)
+	ctx, cancel := context.WithCancel(context.TODO())
+	done := make(chan error)
+	go func() {
+		done <- p.Command(ctx, &buffer{bytes.NewBuffer(nil)}, nil, "echo", "nope")
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 1, p.Queued())
+	cancel()
+	assert.Equal(t, context.Canceled, <-done)
+	assert.Equal(t, 0, p.Queued())
+	p.Release()
+	assert.Equal(t, 0, p.Running())
+}
+
+func TestChildPool(t *testing.T) {
+	parent := NewPool(2)
+	a := parent.Child(1)
+	b := parent.Child(0)
+	assert.NoError(t, a.Acquire(context.TODO()))
+	assert.NoError(t, b.Acquire(context.TODO()))
+	assert.Equal(t, 2, parent.Running())
+
+	acquired := make(chan interface{})
+	go func() {
+		assert.NoError(t, b.Acquire(context.TODO()))
+		close(acquired)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, 1, parent.Queued())
+	a.Release()
+	<-acquired
+	assert.Equal(t, 2, b.Running())
+	assert.Equal(t, 0, a.Running())
+
+	parent.SetSize(3)
+	assert.NoError(t, a.Acquire(context.TODO()))
+	assert.Equal(t, 3, parent.Running())
+}
+
+func TestJobQueue(t *testing.T) {
+	p := NewPool(1)
+	assert.NoError(t, p.Acquire(context.TODO()))
+	jobs := make([]*Job, 3)
+	for i := range jobs {
+		jobs[i] = NewJob(&buffer{bytes.NewBuffer(nil)}, nil, "echo", "hello")
+		assert.Equal(t, Pending, jobs[i].State())
+		go p.Run(context.TODO(), jobs[i])
+		<-jobs[i].Scheduled()
+		assert.Equal(t, Queued, jobs[i].State())
+		assert.Equal(t, i+1, jobs[i].Position())
+	}
+	p.Release()
+	for _, job := range jobs {
+		for job.State() != Finished {
+			time.Sleep(time.Millisecond)
+		}
+		assert.Equal(t, 0, job.Position())
+	}
+}
+
+func TestMaxDuration(t *testing.T) {
+	p := NewPool(0)
+	out := &buffer{bytes.NewBuffer(nil)}
+	job := NewJob(out, nil, "sh", "-c", "trap 'echo term' TERM; echo start; while true; do sleep 0.01; done")
+	job.MaxDuration = 100 * time.Millisecond
+	job.GracePeriod = 100 * time.Millisecond
+	ts := time.Now()
+	err := p.Run(context.TODO(), job)
+	assert.Error(t, err)
+	assert.True(t, job.TimedOut())
+	assert.Equal(t, Timeout, job.Outcome())
+	assert.True(t, time.Since(ts) >= 200*time.Millisecond)
+	assert.Equal(t, "start\nterm\n", out.String())
+
+	job = NewJob(&buffer{bytes.NewBuffer(nil)}, nil, "sleep", "10")
+	job.MaxDuration = 100 * time.Millisecond
+	ts = time.Now()
+	err = p.Run(context.TODO(), job)
+	assert.Error(t, err)
+	assert.True(t, job.TimedOut())
+	assert.True(t, time.Since(ts) < time.Second)
+}
+
+func TestOutcome(t *testing.T) {
+	p := NewPool(0)
+	job := NewJob(&buffer{bytes.NewBuffer(nil)}, nil, "sh", "-c", "sleep 0.1")
+	assert.Equal(t, -1, job.ExitCode())
+	assert.NoError(t, p.Run(context.TODO(), job))
+	assert.Equal(t, Success, job.Outcome())
+	assert.Equal(t, 0, job.ExitCode())
+	assert.True(t, job.Duration() >= 100*time.Millisecond)
+
+	job = NewJob(&buffer{bytes.NewBuffer(nil)}, nil, "sh", "-c", "exit 3")
+	assert.Error(t, p.Run(context.TODO(), job))
+	assert.Equal(t, Failed, job.Outcome())
+	assert.Equal(t, 3, job.ExitCode())
+	assert.Error(t, job.Err())
+
+	job = NewJob(&buffer{bytes.NewBuffer(nil)}, nil, "/not/a/command")
+	assert.Error(t, p.Run(context.TODO(), job))
+	assert.Equal(t, Failed, job.Outcome())
+	assert.Equal(t, -1, job.ExitCode())
+	assert.True(t, job.Started().IsZero())
+
+	ctx, cancel := context.WithTimeout(context.TODO(), 100*time.Millisecond)
+	defer cancel()
+	job = NewJob(&buffer{bytes.NewBuffer(nil)}, nil, "sleep", "10")
+	assert.Error(t, p.Run(ctx, job))
+	assert.Equal(t, Cancelled, job.Outcome())
+	assert.Equal(t, -1, job.ExitCode())
+}
+
+func TestSignal(t *testing.T) {
+	p := NewPool(0)
+	out := &buffer{bytes.NewBuffer(nil)}
+	job := NewJob(out, nil, "sh", "-c", "trap 'echo usr1; exit 3' USR1; echo start; while true; do sleep 0.01; done")
+	assert.Error(t, job.Signal(syscall.SIGUSR1))
+	done := make(chan error)
+	go func() {
+		done <- p.Run(context.TODO(), job)
+	}()
+	time.Sleep(100 * time.Millisecond)
+	assert.NoError(t, job.Signal(syscall.SIGUSR1))
+	assert.Error(t, <-done)
+	assert.Equal(t, 3, job.ExitCode())
+	assert.Equal(t, "start\nusr1\n", out.String())
+	assert.Error(t, job.Signal(syscall.SIGUSR1))
+}
@@ -0,0 +1,321 @@
+package command
+
+import (
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// DefaultGracePeriod between SIGTERM and SIGKILL
+const DefaultGracePeriod = 5 * time.Second
+
+// State of a Job
+type State int
+
+const (
+	// Pending Job is not yet handled by a Pool
+	Pending State = iota
+	// Queued Job waits for a free slot
+	Queued
+	// Running Job has its process
+	Running
+	// Finished Job is done, or canceled
+	Finished
+)
+
+func (s State) String() string {
+	switch s {
+	case Pending:
+		return "pending"
+	case Queued:
+		return "queued"
+	case Running:
+		return "running"
+	case Finished:
+		return "finished"
+	}
+	return "unknown"
+}
+
+// Outcome of a finished Job
+type Outcome string
+
+const (
+	// Success : exit code 0
+	Success Outcome = "success"
+	// Failed : the command failed, or was not started
+	Failed Outcome = "failed"
+	// Cancelled : the context was canceled
+	Cancelled Outcome = "cancelled"
+	// Timeout : killed after MaxDuration
+	Timeout Outcome = "timeout"
+	// Interrupted : cut off by a server restart
+	Interrupted Outcome = "interrupted"
+)
+
+// Job is a command, waiting for a slot in a Pool, then running.
+// Without Stderr, the process uses the server's STDERR.
+// A Job running longer than MaxDuration gets a SIGTERM, then a SIGKILL
+// after GracePeriod.
+type Job struct {
+	Name        string
+	Args        []string
+	Env         map[string]string
+	Stdout      io.WriteCloser
+	Stderr      io.WriteCloser
+	MaxDuration time.Duration
+	GracePeriod time.Duration
+	ticket      *ticket
+	timedOut    bool
+	started     time.Time
+	ended       time.Time
+	exitCode    int
+	err         error
+	outcome     Outcome
+	process     *os.Process
+	lock        *sync.RWMutex
+	state       State
+	scheduled   chan interface{}
+	once        *sync.Once
+}
+
+// NewJob returns a pending Job
+func NewJob(out io.WriteCloser, env map[string]string, name string, args ...string) *Job {
+	j := &Job{
+		Name:      name,
+		Args:      args,
+		Env:       env,
+		Stdout:    out,
+		lock:      &sync.RWMutex{},
+		state:     Pending,
+		exitCode:  -1,
+		scheduled: make(chan interface{}),
+		once:      &sync.Once{},
+	}
+	j.ticket = &ticket{
+		lock: &sync.Mutex{},
+		job:  j,
+	}
+	return j
+}
+
+// RestoreJob returns a finished Job, run by a previous server
+func RestoreJob(name string, args []string, started, ended time.Time, exitCode int, outcome Outcome) *Job {
+	j := NewJob(nil, nil, name, args...)
+	j.started = started
+	j.ended = ended
+	j.exitCode = exitCode
+	j.outcome = outcome
+	j.setState(Finished)
+	return j
+}
+
+// State of the Job
+func (j *Job) State() State {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return j.state
+}
+
+// Position in the queue, 1 is the next one, 0 is not queued
+func (j *Job) Position() int {
+	return j.ticket.position()
+}
+
+// Scheduled is closed when the Job is no more pending
+func (j *Job) Scheduled() <-chan interface{} {
+	return j.scheduled
+}
+
+func (j *Job) setState(state State) {
+	j.lock.Lock()
+	j.state = state
+	j.lock.Unlock()
+	if state != Pending {
+		j.once.Do(func() {
+			close(j.scheduled)
+		})
+	}
+}
+
+// TimedOut says if the Job was killed for running longer than MaxDuration
+func (j *Job) TimedOut() bool {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return j.timedOut
+}
+
+// watch kills the process group when the context is canceled, or after MaxDuration
+func (j *Job) watch(ctx context.Context, process *os.Process, done chan interface{}) {
+	var timeout <-chan time.Time
+	if j.MaxDuration > 0 {
+		timer := time.NewTimer(j.MaxDuration)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-done:
+		return
+	case <-ctx.Done():
+		signalGroup(process, syscall.SIGKILL)
+		return
+	case <-timeout:
+	}
+	j.lock.Lock()
+	j.timedOut = true
+	j.lock.Unlock()
+	signalGroup(process, syscall.SIGTERM)
+	grace := j.GracePeriod
+	if grace <= 0 {
+		grace = DefaultGracePeriod
+	}
+	timer := time.NewTimer(grace)
+	defer timer.Stop()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		signalGroup(process, syscall.SIGKILL)
+	case <-timer.C:
+		signalGroup(process, syscall.SIGKILL)
+	}
+}
+
+func (j *Job) start(process *os.Process) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.started = time.Now()
+	j.process = process
+}
+
+func (j *Job) exit(code int) {
+	j.lock.Lock()
+	defer j.lock.Unlock()
+	j.ended = time.Now()
+	j.exitCode = code
+	j.process = nil
+}
+
+// Signal sends a signal to the process group of a running Job
+func (j *Job) Signal(sig syscall.Signal) error {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	if j.process == nil {
+		return fmt.Errorf("Job is not running")
+	}
+	return signalGroup(j.process, sig)
+}
+
+func (j *Job) finish(ctx context.Context, err error) {
+	j.lock.Lock()
+	if j.ended.IsZero() { // never started
+		j.ended = time.Now()
+	}
+	j.err = err
+	switch {
+	case j.timedOut:
+		j.outcome = Timeout
+	case ctx.Err() != nil:
+		j.outcome = Cancelled
+	case err == nil:
+		j.outcome = Success
+	default:
+		j.outcome = Failed
+	}
+	j.lock.Unlock()
+	j.setState(Finished)
+}
+
+// Started is when the process started, zero if it never started
+func (j *Job) Started() time.Time {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return j.started
+}
+
+// Ended is when the process exited, or the Job was canceled, zero if it's still running
+func (j *Job) Ended() time.Time {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return j.ended
+}
+
+// Duration of the process, up to now if it's still running
+func (j *Job) Duration() time.Duration {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	if j.started.IsZero() {
+		return 0
+	}
+	if j.ended.IsZero() {
+		return time.Since(j.started)
+	}
+	return j.ended.Sub(j.started)
+}
+
+// ExitCode of the process, -1 if it was not started, or killed by a signal
+func (j *Job) ExitCode() int {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return j.exitCode
+}
+
+// Err is the error returned by the Pool, once finished
+func (j *Job) Err() error {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return j.err
+}
+
+// Outcome of the Job, empty while it's not finished
+func (j *Job) Outcome() Outcome {
+	j.lock.RLock()
+	defer j.lock.RUnlock()
+	return j.outcome
+}
+
+// ticket is a place in the queue of a Pool
+type ticket struct {
+	lock *sync.Mutex
+	pool *Pool
+	elem *list.Element
+	job  *Job
+}
+
+func newTicket() *ticket {
+	return &ticket{
+		lock: &sync.Mutex{},
+	}
+}
+
+func (t *ticket) queue(pool *Pool, elem *list.Element) {
+	t.lock.Lock()
+	t.pool = pool
+	t.elem = elem
+	t.lock.Unlock()
+	if t.job != nil {
+		t.job.setState(Queued)
+	}
+}
+
+func (t *ticket) dequeue() {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	t.pool = nil
+	t.elem = nil
+}
+
+func (t *ticket) position() int {
+	t.lock.Lock()
+	pool := t.pool
+	elem := t.elem
+	t.lock.Unlock()
+	if pool == nil {
+		return 0
+	}
+	return pool.position(elem)
+}
@@ -0,0 +1,19 @@
+package command
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// newProcessGroup starts the command in its own process group
+func newProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{
+		Setpgid: true,
+	}
+}
+
+// signalGroup signals the process and all its descendants
+func signalGroup(process *os.Process, sig syscall.Signal) error {
+	return syscall.Kill(-process.Pid, sig)
+}
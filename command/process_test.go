@@ -0,0 +1,81 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// alive says if a process exists, and is not a zombie
+func alive(pid int) bool {
+	if syscall.Kill(pid, 0) != nil {
+		return false
+	}
+	stat, err := ioutil.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return true
+	}
+	fields := strings.Fields(string(stat))
+	return len(fields) < 3 || fields[2] != "Z"
+}
+
+func descendants(t *testing.T, out *buffer) []int {
+	pids := make([]int, 0)
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		pid, err := strconv.Atoi(line)
+		assert.NoError(t, err)
+		pids = append(pids, pid)
+	}
+	return pids
+}
+
+const forking = `sleep 10 & echo $!; sh -c 'sleep 10 & echo $!; wait' & echo $!; wait`
+
+func TestKillGroup(t *testing.T) {
+	p := NewPool(0)
+	out := &buffer{bytes.NewBuffer(nil)}
+	ctx, cancel := context.WithCancel(context.TODO())
+	done := make(chan error)
+	go func() {
+		done <- p.Run(ctx, NewJob(out, nil, "sh", "-c", forking))
+	}()
+	time.Sleep(100 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-done:
+		assert.Error(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("The command is still running")
+	}
+	pids := descendants(t, out)
+	assert.Len(t, pids, 3)
+	time.Sleep(10 * time.Millisecond)
+	for _, pid := range pids {
+		assert.False(t, alive(pid), pid)
+	}
+}
+
+func TestTimeoutGroup(t *testing.T) {
+	p := NewPool(0)
+	out := &buffer{bytes.NewBuffer(nil)}
+	job := NewJob(out, nil, "sh", "-c", forking)
+	job.MaxDuration = 100 * time.Millisecond
+	job.GracePeriod = 100 * time.Millisecond
+	err := p.Run(context.TODO(), job)
+	assert.Error(t, err)
+	assert.True(t, job.TimedOut())
+	pids := descendants(t, out)
+	assert.Len(t, pids, 3)
+	time.Sleep(10 * time.Millisecond)
+	for _, pid := range pids {
+		assert.False(t, alive(pid), pid)
+	}
+}
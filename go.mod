@@ -4,5 +4,8 @@ go 1.15
 
 require (
 	github.com/google/uuid v1.3.0
+	github.com/gorilla/websocket v1.4.2
+	github.com/pmezard/go-difflib v1.0.0
 	github.com/stretchr/testify v1.7.0
+	gopkg.in/yaml.v3 v3.0.0-20200313102051-9f266ea9e77c
 )
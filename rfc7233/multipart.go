@@ -0,0 +1,67 @@
+package rfc7233
+
+import (
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/textproto"
+	"sort"
+)
+
+// Coalesce sorts the intervals, and merges the ones which overlap or touch.
+// An open interval swallows all the intervals after its start.
+func Coalesce(intervals []Interval) []Interval {
+	sorted := make([]Interval, len(intervals))
+	copy(sorted, intervals)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Start < sorted[j].Start
+	})
+	coalesced := make([]Interval, 0, len(sorted))
+	for _, i := range sorted {
+		if len(coalesced) > 0 {
+			last := &coalesced[len(coalesced)-1]
+			if last.End < 0 || i.Start <= last.End {
+				if last.End >= 0 && (i.End < 0 || i.End > last.End) {
+					last.End = i.End
+				}
+				continue
+			}
+		}
+		coalesced = append(coalesced, i)
+	}
+	return coalesced
+}
+
+// MultipartWriter writes a multipart/byteranges body, one part per range
+type MultipartWriter struct {
+	w           *multipart.Writer
+	contentType string
+	length      int
+}
+
+// NewMultipartWriter returns a MultipartWriter for a content of a type and a length
+func NewMultipartWriter(w io.Writer, contentType string, length int) *MultipartWriter {
+	return &MultipartWriter{
+		w:           multipart.NewWriter(w),
+		contentType: contentType,
+		length:      length,
+	}
+}
+
+// ContentType of the whole body, with its boundary
+func (m *MultipartWriter) ContentType() string {
+	return "multipart/byteranges; boundary=" + m.w.Boundary()
+}
+
+// CreatePart writes the headers of a part, its content is written in the returned Writer
+func (m *MultipartWriter) CreatePart(i Interval) (io.Writer, error) {
+	header := make(textproto.MIMEHeader)
+	header.Set("Content-Type", m.contentType)
+	header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", i.Start, i.End-1, m.length))
+	return m.w.CreatePart(header)
+}
+
+// Close writes the final boundary
+func (m *MultipartWriter) Close() error {
+	return m.w.Close()
+}
@@ -0,0 +1,53 @@
+package rfc7233
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCoalesce(t *testing.T) {
+	assert.Equal(t, []Interval{{0, 5}, {8, 10}},
+		Coalesce([]Interval{{8, 10}, {3, 5}, {0, 4}}))
+	assert.Equal(t, []Interval{{0, 10}},
+		Coalesce([]Interval{{0, 5}, {5, 10}}))
+	assert.Equal(t, []Interval{{0, 2}, {4, -1}},
+		Coalesce([]Interval{{6, 8}, {4, -1}, {0, 2}, {5, 12}}))
+}
+
+func TestMultipartWriter(t *testing.T) {
+	content := []byte("Je mange des carottes")
+	buff := &bytes.Buffer{}
+	m := NewMultipartWriter(buff, "text/plain", len(content))
+	intervals := []Interval{{0, 2}, {13, 21}}
+	for _, i := range intervals {
+		w, err := m.CreatePart(i)
+		assert.NoError(t, err)
+		_, err = w.Write(content[i.Start:i.End])
+		assert.NoError(t, err)
+	}
+	assert.NoError(t, m.Close())
+
+	mediaType, params, err := mime.ParseMediaType(m.ContentType())
+	assert.NoError(t, err)
+	assert.Equal(t, "multipart/byteranges", mediaType)
+	reader := multipart.NewReader(buff, params["boundary"])
+	for _, want := range []struct {
+		rang string
+		body string
+	}{{"bytes 0-1/21", "Je"}, {"bytes 13-20/21", "carottes"}} {
+		part, err := reader.NextPart()
+		assert.NoError(t, err)
+		assert.Equal(t, "text/plain", part.Header.Get("Content-Type"))
+		assert.Equal(t, want.rang, part.Header.Get("Content-Range"))
+		body, err := ioutil.ReadAll(part)
+		assert.NoError(t, err)
+		assert.Equal(t, want.body, string(body))
+	}
+	_, err = reader.NextPart()
+	assert.Error(t, err)
+}
@@ -1,6 +1,7 @@
 package rfc7233
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"strconv"
@@ -35,17 +36,66 @@ func parseRange(raw string) (*Range, error) {
 		}
 		rang.end = true
 	}
+	if !rang.start && !rang.end {
+		return nil, fmt.Errorf("Empty range : %s", raw)
+	}
+	if rang.min < 0 || rang.max < 0 || (rang.start && rang.end && rang.min > rang.max) {
+		return nil, fmt.Errorf("Bad range : %s", raw)
+	}
 	return rang, nil
 }
 
+// ErrUnsatisfiable is returned when no range overlaps the content
+var ErrUnsatisfiable = errors.New("Unsatisfiable range")
+
+// Interval is a resolved range, End is excluded, -1 for an open range
+type Interval struct {
+	Start int
+	End   int
+}
+
+// Len is the length of the interval, -1 for an open interval
+func (i Interval) Len() int {
+	if i.End < 0 {
+		return -1
+	}
+	return i.End - i.Start
+}
+
+// resolve the range against a content length, -1 for an unknown length
+func (r *Range) resolve(length int) (Interval, bool) {
+	if !r.start { // suffix range, the tail of the content
+		if length < 0 || r.max == 0 {
+			return Interval{}, false
+		}
+		start := length - r.max
+		if start < 0 {
+			start = 0
+		}
+		return Interval{start, length}, true
+	}
+	if length >= 0 && r.min >= length {
+		return Interval{}, false
+	}
+	end := length
+	if r.end && (length < 0 || r.max < length) {
+		end = r.max + 1
+	}
+	return Interval{r.min, end}, true
+}
+
 type Ranges struct {
 	ranges []*Range
 	r      int
 }
 
+// ErrUnknownUnit is returned for a range unit other than bytes, the
+// Range header must be ignored
+var ErrUnknownUnit = errors.New("Unknown range unit")
+
 func Parse(raw string) (*Ranges, error) {
 	if !strings.HasPrefix(raw, "bytes=") {
-		return nil, fmt.Errorf("It doesn't start with bytes= : %s", raw)
+		return nil, ErrUnknownUnit
 	}
 	r := strings.Split(raw[6:], ",")
 	if len(r) == 0 {
@@ -68,6 +118,22 @@ func (r *Ranges) Len() int {
 	return len(r.ranges)
 }
 
+// Resolve the ranges against a content length, -1 for an unknown length.
+// Unsatisfiable ranges are skipped, ErrUnsatisfiable is returned if none is left.
+func (r *Ranges) Resolve(length int) ([]Interval, error) {
+	intervals := make([]Interval, 0, len(r.ranges))
+	for _, rang := range r.ranges {
+		i, ok := rang.resolve(length)
+		if ok {
+			intervals = append(intervals, i)
+		}
+	}
+	if len(intervals) == 0 {
+		return nil, ErrUnsatisfiable
+	}
+	return intervals, nil
+}
+
 func (r *Ranges) Next() error {
 	if r.r == len(r.ranges) {
 		return io.EOF
@@ -36,3 +36,39 @@ func TestNext(t *testing.T) {
 	}
 	assert.Equal(t, []int{1, 2, 3, 5, 6, 7, 8, 9}, stack)
 }
+
+func TestBadRange(t *testing.T) {
+	for _, raw := range []string{"bytes=-", "bytes=5-1", "bytes=a-", "bytes=1-2-3"} {
+		_, err := Parse(raw)
+		assert.Error(t, err, raw)
+	}
+	_, err := Parse("octets=1-")
+	assert.Equal(t, ErrUnknownUnit, err)
+}
+
+func TestResolve(t *testing.T) {
+	r, err := Parse("bytes=2-4,8-,-3,20-30,-0")
+	assert.NoError(t, err)
+	intervals, err := r.Resolve(10)
+	assert.NoError(t, err)
+	assert.Equal(t, []Interval{{2, 5}, {8, 10}, {7, 10}}, intervals)
+
+	r, err = Parse("bytes=0-99,-100")
+	assert.NoError(t, err)
+	intervals, err = r.Resolve(10)
+	assert.NoError(t, err)
+	assert.Equal(t, []Interval{{0, 10}, {0, 10}}, intervals)
+
+	r, err = Parse("bytes=2-4,8-,-3")
+	assert.NoError(t, err)
+	intervals, err = r.Resolve(-1)
+	assert.NoError(t, err)
+	assert.Equal(t, []Interval{{2, 5}, {8, -1}}, intervals)
+	assert.Equal(t, 3, intervals[0].Len())
+	assert.Equal(t, -1, intervals[1].Len())
+
+	r, err = Parse("bytes=10-,-0")
+	assert.NoError(t, err)
+	_, err = r.Resolve(10)
+	assert.Equal(t, ErrUnsatisfiable, err)
+}
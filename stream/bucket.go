@@ -3,6 +3,7 @@ package stream
 import (
 	"bytes"
 	"crypto/sha256"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"hash"
@@ -10,6 +11,7 @@ import (
 	"os"
 	_path "path"
 	"sync"
+	"time"
 
 	"github.com/google/uuid"
 )
@@ -23,8 +25,16 @@ type Bucket struct {
 	home   string
 	size   int
 	closed bool
+	length int
 	lock   *sync.RWMutex
 	hash   hash.Hash
+	sum    []byte
+	// metadata is written in the manifest
+	metadata    json.RawMessage
+	interrupted bool
+	// stampsLog is the log of the write times, stamped is its number of records
+	stampsLog *os.File
+	stamped   int
 }
 
 // NewBucket returns a new Bucket, with its home and size
@@ -44,7 +54,6 @@ func NewBucket(home string, size int) (*Bucket, error) {
 		lock:   &sync.RWMutex{},
 		hash:   sha256.New(),
 	}
-	b.buffer.Grow(size)
 	err = b.reset()
 	return b, err
 }
@@ -62,6 +71,9 @@ func (b *Bucket) Path() string {
 func (b *Bucket) reset() error {
 	b.lock.Lock()
 	defer b.lock.Unlock()
+	if b.closed {
+		return errClosed
+	}
 	b.n++
 	var err error
 	if b.file != nil {
@@ -80,7 +92,7 @@ func (b *Bucket) reset() error {
 		return err
 	}
 	b.buffer.Reset()
-	return nil
+	return b.writeManifest()
 }
 
 // Len length of all buckets
@@ -88,11 +100,7 @@ func (b *Bucket) Len() int {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
 	if b.closed {
-		s, err := os.Stat(BucketPath(b.home, b.n))
-		if err != nil {
-			panic(err)
-		}
-		return ((b.n - 1) * b.size) + int(s.Size())
+		return b.length
 	}
 	return ((b.n - 1) * b.size) + b.buffer.Len()
 }
@@ -109,6 +117,9 @@ func (b *Bucket) maxChunkSize() int {
 
 func (b *Bucket) write(chunk []byte) (int, error) {
 	// assert len(chunk) <= maxChinkSize
+	if b.buffer.Cap() == 0 { // the buffer is allocated by the first write
+		b.buffer.Grow(b.size)
+	}
 	return io.MultiWriter(b.file, b.buffer, b.hash).Write(chunk)
 }
 
@@ -116,18 +127,38 @@ func (b *Bucket) write(chunk []byte) (int, error) {
 func (b *Bucket) Hash() []byte {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
+	if b.sum != nil {
+		return b.sum
+	}
 	return b.hash.Sum(nil)
 }
 
-// Write a bite
+var errClosed = errors.New("Closed bucket")
+
+// Write a bite, its write time is recorded
 func (b *Bucket) Write(bite []byte) (int, error) {
-	if b.closed {
-		return 0, errors.New("Closed bucket")
+	if b.Closed() {
+		return 0, errClosed
 	}
+	if len(bite) == 0 {
+		return 0, nil
+	}
+	now := time.Now()
 	start := 0
 	lbite := len(bite)
 	for {
 		b.lock.Lock()
+		if b.closed { // closed, or removed, by another goroutine
+			b.lock.Unlock()
+			return start, errClosed
+		}
+		if start == 0 {
+			err := b.stamp(now)
+			if err != nil {
+				b.lock.Unlock()
+				return 0, err
+			}
+		}
 		size := min(b.maxChunkSize(), lbite-start)
 		n, err := b.write(bite[start : start+size])
 		b.lock.Unlock()
@@ -150,23 +181,69 @@ func (b *Bucket) Write(bite []byte) (int, error) {
 func (b *Bucket) Close() error {
 	b.lock.Lock()
 	defer b.lock.Unlock()
+	return b.close()
+}
+
+func (b *Bucket) close() error {
+	if b.closed {
+		return nil
+	}
 	err := b.file.Chmod(0400)
 	if err != nil {
 		return err
 	}
+	b.length = ((b.n - 1) * b.size) + b.buffer.Len()
+	b.sum = b.hash.Sum(nil)
 	b.buffer = nil // free some RAM
 	b.closed = true
-	return b.file.Close()
+	err = b.file.Close()
+	if err != nil {
+		return err
+	}
+	if b.stampsLog != nil {
+		err = b.stampsLog.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return b.writeManifest()
 }
 
 func (b *Bucket) Closed() bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
 	return b.closed
 }
 
+// Remove closes the bucket, and deletes its storage folder
+func (b *Bucket) Remove() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	err := b.close()
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(b.home)
+}
+
 // Cache return a copy of the last bucket buffer
 func (b *Bucket) Cache(start int) []byte {
 	b.lock.RLock()
 	defer b.lock.RUnlock()
+	return b.cacheBytes(start)
+}
+
+// cache returns a copy of the buffer, if the nth bucket is still the last one
+func (b *Bucket) cache(n, start int) ([]byte, bool) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if b.n != n || b.closed {
+		return nil, false
+	}
+	return b.cacheBytes(start), true
+}
+
+func (b *Bucket) cacheBytes(start int) []byte {
 	bb := b.buffer.Bytes()
 	if start > len(bb) {
 		return []byte{}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"os"
 	"testing"
+	"time"
 
 	"io/ioutil"
 
@@ -32,3 +33,208 @@ func TestBucket(t *testing.T) {
 	assert.Equal(t, txt, buff.Bytes())
 	assert.Equal(t, 21, b.Len())
 }
+
+func TestLazyBuffer(t *testing.T) {
+	home, err := ioutil.TempDir(os.TempDir(), "buck_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	b, err := NewBucket(home, 1024*1024)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, b.buffer.Cap())
+	_, err = b.Write([]byte("hello"))
+	assert.NoError(t, err)
+	assert.True(t, b.buffer.Cap() >= 1024*1024)
+}
+
+func TestCopyRange(t *testing.T) {
+	home, err := ioutil.TempDir(os.TempDir(), "buck_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	b, err := NewBucket(home, 6)
+	assert.NoError(t, err)
+	_, err = b.Write([]byte("Je mange des carottes"))
+	assert.NoError(t, err)
+	// the bucket is still open, the end of the range is already written
+	buff := bytes.NewBuffer(nil)
+	assert.NoError(t, b.CopyRange(3, 15, buff))
+	assert.Equal(t, "mange des ca", buff.String())
+	assert.NoError(t, b.Close())
+	buff.Reset()
+	assert.NoError(t, b.CopyRange(13, -1, buff))
+	assert.Equal(t, "carottes", buff.String())
+	buff.Reset()
+	assert.NoError(t, b.CopyRange(5, 5, buff))
+	assert.Equal(t, "", buff.String())
+}
+
+func TestWrittenAt(t *testing.T) {
+	home, err := ioutil.TempDir(os.TempDir(), "buck_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	b, err := NewBucket(home, 6)
+	assert.NoError(t, err)
+	assert.True(t, b.WrittenAt(0).IsZero())
+	before := time.Now()
+	_, err = b.Write([]byte("Je mange"))
+	assert.NoError(t, err)
+	time.Sleep(20 * time.Millisecond)
+	middle := time.Now()
+	_, err = b.Write([]byte(" des carottes"))
+	assert.NoError(t, err)
+	assert.NoError(t, b.Close())
+
+	first := b.WrittenAt(7)
+	second := b.WrittenAt(8)
+	assert.True(t, !first.Before(before) && first.Before(middle))
+	assert.True(t, !second.Before(middle))
+	assert.Equal(t, second, b.WrittenAt(20))
+	assert.Equal(t, 32, b.StampsLen())
+
+	b2, err := OpenBucket(b.Path())
+	assert.NoError(t, err)
+	assert.Equal(t, 32, b2.StampsLen())
+	assert.True(t, first.Equal(b2.WrittenAt(0)))
+	assert.True(t, second.Equal(b2.WrittenAt(12)))
+}
+
+func TestStamps(t *testing.T) {
+	home, err := ioutil.TempDir(os.TempDir(), "buck_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	b, err := NewBucket(home, 6)
+	assert.NoError(t, err)
+	stamps := b.Stamps()
+	defer stamps.Close()
+	assert.True(t, stamps.At(0).IsZero())
+	_, err = b.Write([]byte("Je mange"))
+	assert.NoError(t, err)
+	first := b.WrittenAt(0)
+	assert.Equal(t, first, stamps.At(7))
+	time.Sleep(20 * time.Millisecond)
+	_, err = b.Write([]byte(" des carottes"))
+	assert.NoError(t, err)
+	second := b.WrittenAt(8)
+	assert.True(t, second.After(first))
+	assert.Equal(t, first, stamps.At(7))
+	assert.Equal(t, second, stamps.At(8))
+	assert.Equal(t, second, stamps.At(20))
+	assert.NoError(t, b.Close())
+}
+
+func TestStampsInterrupted(t *testing.T) {
+	home, err := ioutil.TempDir(os.TempDir(), "buck_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	b, err := NewBucket(home, 6)
+	assert.NoError(t, err)
+	_, err = b.Write([]byte("Je mange"))
+	assert.NoError(t, err)
+	_, err = b.Write([]byte(" des carottes"))
+	assert.NoError(t, err)
+	first := b.WrittenAt(0)
+	second := b.WrittenAt(8)
+
+	// cut off by a restart, without Close
+	b2, err := OpenBucket(b.Path())
+	assert.NoError(t, err)
+	assert.True(t, b2.Interrupted())
+	assert.Equal(t, 32, b2.StampsLen())
+	assert.False(t, b2.WrittenAt(0).IsZero())
+	assert.True(t, first.Equal(b2.WrittenAt(0)))
+	assert.True(t, second.Equal(b2.WrittenAt(20)))
+}
+
+func TestRemove(t *testing.T) {
+	home, err := ioutil.TempDir(os.TempDir(), "buck_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	b, err := NewBucket(home, 6)
+	assert.NoError(t, err)
+	_, err = b.Write([]byte("Je mange des carottes"))
+	assert.NoError(t, err)
+	err = b.Remove()
+	assert.NoError(t, err)
+	assert.True(t, b.Closed())
+	assert.Equal(t, 21, b.Len())
+	_, err = os.Stat(b.Path())
+	assert.True(t, os.IsNotExist(err))
+	_, err = b.Write([]byte("encore"))
+	assert.Error(t, err)
+}
+
+func TestRemoveWhileWriting(t *testing.T) {
+	home, err := ioutil.TempDir(os.TempDir(), "buck_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	b, err := NewBucket(home, 6)
+	assert.NoError(t, err)
+	done := make(chan error)
+	go func() {
+		for {
+			_, err := b.Write([]byte("Je mange des carottes"))
+			if err != nil {
+				done <- err
+				return
+			}
+		}
+	}()
+	time.Sleep(10 * time.Millisecond)
+	assert.NoError(t, b.Remove())
+	assert.Equal(t, errClosed, <-done)
+}
+
+func TestOpenBucket(t *testing.T) {
+	home, err := ioutil.TempDir(os.TempDir(), "buck_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	b, err := NewBucket(home, 6)
+	assert.NoError(t, err)
+	txt := []byte("Je mange des carottes")
+	_, err = b.Write(txt)
+	assert.NoError(t, err)
+	assert.NoError(t, b.SetMetadata(map[string]string{"name": "carottes"}))
+	assert.NoError(t, b.Close())
+
+	b2, err := OpenBucket(b.Path())
+	assert.NoError(t, err)
+	assert.Equal(t, b.ID(), b2.ID())
+	assert.True(t, b2.Closed())
+	assert.False(t, b2.Interrupted())
+	assert.Equal(t, 21, b2.Len())
+	assert.Equal(t, b.Hash(), b2.Hash())
+	meta := make(map[string]string)
+	ok, err := b2.Metadata(&meta)
+	assert.True(t, ok)
+	assert.NoError(t, err)
+	assert.Equal(t, "carottes", meta["name"])
+	buff := bytes.NewBuffer(nil)
+	assert.NoError(t, b2.Copy(0, buff))
+	assert.Equal(t, txt, buff.Bytes())
+}
+
+func TestOpenInterruptedBucket(t *testing.T) {
+	home, err := ioutil.TempDir(os.TempDir(), "buck_")
+	assert.NoError(t, err)
+	defer os.RemoveAll(home)
+	b, err := NewBucket(home, 6)
+	assert.NoError(t, err)
+	txt := []byte("Je mange des carottes")
+	_, err = b.Write(txt)
+	assert.NoError(t, err)
+	// no Close, the server is killed
+
+	b2, err := OpenBucket(b.Path())
+	assert.NoError(t, err)
+	assert.True(t, b2.Closed())
+	assert.True(t, b2.Interrupted())
+	assert.Equal(t, 21, b2.Len())
+	assert.Equal(t, b.Hash(), b2.Hash())
+	buff := bytes.NewBuffer(nil)
+	assert.NoError(t, b2.Copy(0, buff))
+	assert.Equal(t, txt, buff.Bytes())
+
+	b3, err := OpenBucket(b.Path())
+	assert.NoError(t, err)
+	assert.False(t, b3.Interrupted())
+	assert.Equal(t, b.Hash(), b3.Hash())
+}
@@ -1,6 +1,7 @@
 package stream
 
 import (
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -8,27 +9,33 @@ import (
 )
 
 func (b *Bucket) seekMyCopy(seek int, w io.Writer) (int, error) {
+	b.lock.RLock()
 	nBucket := b.n
+	closed := b.closed
+	b.lock.RUnlock()
 	d := div(seek, b.size)
 	rest := seek - (d * b.size)
 	bucket := d + 1
-	if d == nBucket && rest == 0 && b.closed { // nothing else to do
+	if d == nBucket && rest == 0 && closed { // nothing else to do
 		return 0, io.EOF
 	}
 	if d >= nBucket {
-		if b.closed {
+		if closed {
 			return 0, fmt.Errorf("Bucket overflow %d/%d : %d",
 				bucket, nBucket, rest)
 		}
 		return 0, nil
 	}
 	start := seek - ((bucket - 1) * b.size)
-	if !b.closed && bucket == nBucket {
-		cached := b.Cache(start)
-		if len(cached) == 0 {
-			return 0, nil
+	if !closed && bucket == nBucket {
+		cached, ok := b.cache(nBucket, start)
+		if ok {
+			if len(cached) == 0 {
+				return 0, nil
+			}
+			return w.Write(cached)
 		}
-		return w.Write(cached)
+		// the bucket is full, and written on disk
 	}
 	path := BucketPath(b.home, bucket)
 	f, err := os.OpenFile(path, os.O_RDONLY, 0400)
@@ -44,8 +51,11 @@ func (b *Bucket) seekMyCopy(seek int, w io.Writer) (int, error) {
 	if err != nil {
 		return 0, err
 	}
-	if bucket == nBucket && int(s.Size()) == start {
-		return 0, io.EOF
+	if int(s.Size()) == start {
+		if closed && bucket == nBucket {
+			return 0, io.EOF
+		}
+		return 0, nil
 	}
 	size := 0
 	for {
@@ -82,3 +92,42 @@ func (b *Bucket) Copy(start int, w io.Writer) error {
 		start += n
 	}
 }
+
+// errRangeEnd stops a copy at the end of its range
+var errRangeEnd = errors.New("End of range")
+
+// limitedWriter writes at most n bytes
+type limitedWriter struct {
+	w io.Writer
+	n int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if len(p) < l.n {
+		n, err := l.w.Write(p)
+		l.n -= n
+		return n, err
+	}
+	n, err := l.w.Write(p[:l.n])
+	l.n -= n
+	if err != nil {
+		return n, err
+	}
+	return n, errRangeEnd
+}
+
+// CopyRange copies content of the bucket from start to end (excluded),
+// and waits for fresh data. A negative end copies until the bucket is closed.
+func (b *Bucket) CopyRange(start, end int, w io.Writer) error {
+	if end < 0 {
+		return b.Copy(start, w)
+	}
+	if end <= start {
+		return nil
+	}
+	err := b.Copy(start, &limitedWriter{w: w, n: end - start})
+	if err == errRangeEnd {
+		return nil
+	}
+	return err
+}
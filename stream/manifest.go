@@ -0,0 +1,145 @@
+package stream
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	_path "path"
+	"sync"
+
+	"github.com/google/uuid"
+)
+
+// ManifestName is the name of the manifest file, in the storage folder
+const ManifestName = "manifest.json"
+
+// Manifest describes a Bucket on disk
+type Manifest struct {
+	ID       uuid.UUID       `json:"id"`
+	Size     int             `json:"size"`
+	Chunks   int             `json:"chunks"`
+	Length   int             `json:"length"`
+	Sha256   string          `json:"sha256,omitempty"`
+	Closed   bool            `json:"closed"`
+	Metadata json.RawMessage `json:"metadata,omitempty"`
+}
+
+// writeManifest atomically, the lock must be held
+func (b *Bucket) writeManifest() error {
+	m := Manifest{
+		ID:       b.id,
+		Size:     b.size,
+		Chunks:   b.n,
+		Closed:   b.closed,
+		Metadata: b.metadata,
+	}
+	if b.closed {
+		m.Length = b.length
+		m.Sha256 = hex.EncodeToString(b.sum)
+	} else {
+		m.Length = ((b.n - 1) * b.size) + b.buffer.Len()
+	}
+	raw, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	path := _path.Join(b.home, ManifestName)
+	err = ioutil.WriteFile(path+".tmp", raw, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// SetMetadata stores some JSON metadata in the manifest
+func (b *Bucket) SetMetadata(metadata interface{}) error {
+	raw, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.metadata = raw
+	return b.writeManifest()
+}
+
+// Metadata reads the JSON metadata of the manifest, false without metadata
+func (b *Bucket) Metadata(metadata interface{}) (bool, error) {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	if len(b.metadata) == 0 {
+		return false, nil
+	}
+	return true, json.Unmarshal(b.metadata, metadata)
+}
+
+// Interrupted says if the bucket was reopened without being closed
+func (b *Bucket) Interrupted() bool {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.interrupted
+}
+
+// OpenBucket reopens a Bucket from its storage folder, read only.
+// A Bucket which was not closed, cut off by a restart, is closed, its
+// length and hash are read from its chunks.
+func OpenBucket(path string) (*Bucket, error) {
+	raw, err := ioutil.ReadFile(_path.Join(path, ManifestName))
+	if err != nil {
+		return nil, err
+	}
+	var m Manifest
+	err = json.Unmarshal(raw, &m)
+	if err != nil {
+		return nil, err
+	}
+	b := &Bucket{
+		id:       m.ID,
+		n:        m.Chunks,
+		home:     path,
+		size:     m.Size,
+		closed:   true,
+		length:   m.Length,
+		lock:     &sync.RWMutex{},
+		hash:     sha256.New(),
+		metadata: m.Metadata,
+	}
+	b.stamped, err = countStamps(path)
+	if err != nil {
+		return nil, err
+	}
+	if m.Closed {
+		b.sum, err = hex.DecodeString(m.Sha256)
+		if err != nil {
+			return nil, err
+		}
+		return b, nil
+	}
+	b.interrupted = true
+	b.length = 0
+	for n := 1; ; n++ {
+		f, err := os.Open(BucketPath(path, n))
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		size, err := io.Copy(b.hash, f)
+		f.Close()
+		if err != nil {
+			return nil, err
+		}
+		err = os.Chmod(BucketPath(path, n), 0400)
+		if err != nil {
+			return nil, err
+		}
+		b.n = n
+		b.length += int(size)
+	}
+	b.sum = b.hash.Sum(nil)
+	return b, b.writeManifest()
+}
@@ -0,0 +1,158 @@
+package stream
+
+import (
+	"encoding/binary"
+	"io"
+	"os"
+	_path "path"
+	"sort"
+	"time"
+)
+
+// StampsName is the log of the write times, in the storage folder
+const StampsName = "stamps.log"
+
+// stampSize is the size of a record of the log : offset and unix nano, big endian
+const stampSize = 16
+
+// stamp is the time of a write, which starts at offset
+type stamp struct {
+	offset int
+	time   time.Time
+}
+
+// stamp logs the time of a write at the current length, the lock must be held.
+// The log is sorted by offset, and written at each write : a run cut off by
+// a restart keeps its stamps.
+func (b *Bucket) stamp(now time.Time) error {
+	if b.stampsLog == nil {
+		var err error
+		b.stampsLog, err = os.OpenFile(_path.Join(b.home, StampsName),
+			os.O_CREATE+os.O_APPEND+os.O_WRONLY, 0600)
+		if err != nil {
+			return err
+		}
+	}
+	var raw [stampSize]byte
+	binary.BigEndian.PutUint64(raw[:8], uint64(((b.n-1)*b.size)+b.buffer.Len()))
+	binary.BigEndian.PutUint64(raw[8:], uint64(now.UnixNano()))
+	_, err := b.stampsLog.Write(raw[:])
+	if err != nil {
+		return err
+	}
+	b.stamped++
+	return nil
+}
+
+// StampsLen is the size of the log of the write times
+func (b *Bucket) StampsLen() int {
+	b.lock.RLock()
+	defer b.lock.RUnlock()
+	return b.stamped * stampSize
+}
+
+// WrittenAt is when the byte at offset was written, zero if unknown
+func (b *Bucket) WrittenAt(offset int) time.Time {
+	n := b.StampsLen() / stampSize
+	if n == 0 {
+		return time.Time{}
+	}
+	f, err := os.Open(_path.Join(b.home, StampsName))
+	if err != nil {
+		return time.Time{}
+	}
+	defer f.Close()
+	i := sort.Search(n, func(i int) bool {
+		s, err := readStamp(f, i)
+		return err != nil || s.offset > offset
+	})
+	if i == 0 {
+		return time.Time{}
+	}
+	s, err := readStamp(f, i-1)
+	if err != nil {
+		return time.Time{}
+	}
+	return s.time
+}
+
+// Stamps reads the write times for increasing offsets, without searching
+// the whole log each time. It must be closed.
+type Stamps struct {
+	bucket *Bucket
+	file   *os.File
+	read   int    // number of read records
+	last   stamp  // the last record before the asked offset
+	next   *stamp // the record read after it
+}
+
+// Stamps returns a reader of the write times, from the start
+func (b *Bucket) Stamps() *Stamps {
+	return &Stamps{bucket: b}
+}
+
+// At is when the byte at offset was written, zero if unknown. Offsets
+// must not decrease.
+func (s *Stamps) At(offset int) time.Time {
+	n := s.bucket.StampsLen() / stampSize
+	for {
+		if s.next == nil {
+			if s.read == n {
+				break
+			}
+			if s.file == nil {
+				var err error
+				s.file, err = os.Open(_path.Join(s.bucket.home, StampsName))
+				if err != nil {
+					break
+				}
+			}
+			next, err := readStamp(s.file, s.read)
+			if err != nil {
+				break
+			}
+			s.read++
+			s.next = &next
+		}
+		if s.next.offset > offset {
+			break
+		}
+		s.last = *s.next
+		s.next = nil
+	}
+	return s.last.time
+}
+
+// Close the log
+func (s *Stamps) Close() error {
+	if s.file == nil {
+		return nil
+	}
+	return s.file.Close()
+}
+
+// readStamp reads the ith record of the log of the write times
+func readStamp(f io.ReaderAt, i int) (stamp, error) {
+	var raw [stampSize]byte
+	_, err := f.ReadAt(raw[:], int64(i*stampSize))
+	if err != nil {
+		return stamp{}, err
+	}
+	return stamp{
+		offset: int(binary.BigEndian.Uint64(raw[:8])),
+		time:   time.Unix(0, int64(binary.BigEndian.Uint64(raw[8:]))),
+	}, nil
+}
+
+// countStamps counts the records of the log of the write times, of a
+// storage folder. A record cut off by a restart is ignored.
+func countStamps(path string) (int, error) {
+	info, err := os.Stat(_path.Join(path, StampsName))
+	if os.IsNotExist(err) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return int(info.Size()) / stampSize, nil
+}